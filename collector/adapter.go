@@ -0,0 +1,52 @@
+package collector
+
+import "context"
+
+type legacyRepository struct {
+	BackupRepository
+}
+
+// Wraps a repository that is not aware of contexts so it can be used by the
+// collector. Once the context is done the wrapped call is abandoned and left
+// to finish in background, its result is discarded.
+func NewContextAdapter(repo BackupRepository) ContextBackupRepository {
+	return &legacyRepository{repo}
+}
+
+// Waits for the latest snapshot of the wrapped repository until the context
+// is done, in which case the context error is returned
+func (l *legacyRepository) LatestSnapshot(ctx context.Context) (*BackupSnapshot, error) {
+	type result struct {
+		snapshot *BackupSnapshot
+		err      error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		snapshot, err := l.BackupRepository.LatestSnapshot()
+		done <- result{snapshot, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.snapshot, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Returns the collection settings of the wrapped repository, if any
+func (l *legacyRepository) Options() *RepositoryOptions {
+	if r, ok := l.BackupRepository.(configurableRepository); ok {
+		return r.Options()
+	}
+	return &RepositoryOptions{}
+}
+
+// Returns the type of the wrapped repository, if any
+func (l *legacyRepository) TypeName() string {
+	if r, ok := l.BackupRepository.(typedRepository); ok {
+		return r.TypeName()
+	}
+	return "unknown"
+}
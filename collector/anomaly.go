@@ -0,0 +1,106 @@
+package collector
+
+import (
+	"sort"
+	"time"
+)
+
+// Represents the thresholds used to flag the size of the latest snapshot
+// as anomalous compared to the snapshots before it
+type AnomalyOptions struct {
+	// Number of previous snapshots the baseline is computed from,
+	// the detection is disabled when zero
+	Window int
+	// Maximum decrease from the baseline, e.g. 0.5 flags snapshots
+	// shrinking by more than 50%. Not checked when zero.
+	MaxDecrease float64 `mapstructure:"max_decrease"`
+	// Maximum increase from the baseline, e.g. 1 flags snapshots
+	// growing by more than 100%. Not checked when zero.
+	MaxIncrease float64 `mapstructure:"max_increase"`
+}
+
+// Holds the sizes of the most recent snapshots of a repository,
+// oldest first and including the latest one
+type sizeWindow struct {
+	lastName string
+	sizes    []float64
+}
+
+// Records the size of the latest snapshot, unless it was already recorded,
+// keeping at most limit sizes besides the latest one
+func (w *sizeWindow) add(name string, size float64, limit int) {
+	if len(w.sizes) > 0 && w.lastName == name {
+		return
+	}
+	w.lastName = name
+	w.sizes = append(w.sizes, size)
+	if len(w.sizes) > limit+1 {
+		w.sizes = w.sizes[len(w.sizes)-limit-1:]
+	}
+}
+
+// Returns the mean size of the snapshots before the latest one,
+// false when there is none
+func (w *sizeWindow) baseline() (float64, bool) {
+	if len(w.sizes) < 2 {
+		return 0, false
+	}
+
+	var total float64
+	previous := w.sizes[:len(w.sizes)-1]
+	for _, size := range previous {
+		total += size
+	}
+	return total / float64(len(previous)), true
+}
+
+// Seeds an empty window with the sizes found in the snapshot history,
+// repositories that do not report sizes when listing are left out
+func (w *sizeWindow) seed(history []*BackupSnapshot, dates []time.Time, latest string, limit int) {
+	type sized struct {
+		date time.Time
+		size float64
+	}
+
+	var previous []sized
+	for i, snapshot := range history {
+		if snapshot.Name != latest && snapshot.Size > 0 {
+			previous = append(previous, sized{dates[i], snapshot.Size})
+		}
+	}
+	sort.Slice(previous, func(i, j int) bool {
+		return previous[i].date.Before(previous[j].date)
+	})
+	if len(previous) > limit {
+		previous = previous[len(previous)-limit:]
+	}
+
+	for _, snapshot := range previous {
+		w.sizes = append(w.sizes, snapshot.size)
+	}
+}
+
+// Compares the size of the latest snapshot with the baseline of the repository
+func (collector *backupCollector) checkSize(alias string, state *repositoryState, options AnomalyOptions) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	window, ok := collector.sizeWindows[alias]
+	if !ok {
+		window = &sizeWindow{}
+		window.seed(state.history, state.historyDates, state.snapshot.Name, options.Window)
+		collector.sizeWindows[alias] = window
+	}
+	window.add(state.snapshot.Name, state.snapshot.Size, options.Window)
+
+	baseline, ok := window.baseline()
+	if !ok || baseline == 0 {
+		return
+	}
+
+	state.sizeChecked = true
+	state.sizeBaseline = baseline
+	state.sizeDeviation = (state.snapshot.Size - baseline) / baseline
+	state.sizeAnomaly = (options.MaxDecrease > 0 && state.sizeDeviation < -options.MaxDecrease) ||
+		(options.MaxIncrease > 0 && state.sizeDeviation > options.MaxIncrease)
+}
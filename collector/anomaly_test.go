@@ -0,0 +1,61 @@
+package collector
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSizeWindow(t *testing.T) {
+	window := &sizeWindow{}
+	if _, ok := window.baseline(); ok {
+		t.Errorf("Expected no baseline for an empty window")
+	}
+
+	window.add("first", 100, 2)
+	window.add("second", 200, 2)
+	// Refreshing the same snapshot again must not count twice
+	window.add("second", 200, 2)
+	window.add("third", 300, 2)
+	window.add("fourth", 30, 2)
+
+	baseline, ok := window.baseline()
+	if !ok || baseline != 250 {
+		t.Errorf("Expected a baseline of 250 from the two previous snapshots but got %v", baseline)
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	now := time.Now().UTC()
+	var history []*BackupSnapshot
+	var dates []time.Time
+	for i, size := range []float64{1000, 1100, 900, 100} {
+		date := now.Add(time.Duration(i-4) * 24 * time.Hour)
+		history = append(history, &BackupSnapshot{Name: string(rune('a' + i)), DateString: date.Format(time.UnixDate), Size: size})
+		dates = append(dates, date)
+	}
+
+	c := NewBackupCollector(nil, Options{})
+	state := &repositoryState{snapshot: history[3], history: history, historyDates: dates}
+	c.checkSize("repo", state, AnomalyOptions{Window: 3, MaxDecrease: 0.5})
+
+	if !state.sizeChecked {
+		t.Fatalf("Expected the size to be checked against the history")
+	}
+	if state.sizeBaseline != 1000 {
+		t.Errorf("Expected a baseline of 1000 but got %v", state.sizeBaseline)
+	}
+	if math.Abs(state.sizeDeviation+0.9) > 1e-9 {
+		t.Errorf("Expected a deviation of -0.9 but got %v", state.sizeDeviation)
+	}
+	if !state.sizeAnomaly {
+		t.Errorf("Expected a 90%% shrink to be flagged")
+	}
+
+	next := &BackupSnapshot{Name: "e", Size: 1050}
+	state = &repositoryState{snapshot: next}
+	c.checkSize("repo", state, AnomalyOptions{Window: 3, MaxDecrease: 0.5, MaxIncrease: 1})
+	if state.sizeAnomaly {
+		t.Errorf("Expected a size within the thresholds not to be flagged, deviation %v", state.sizeDeviation)
+	}
+}
@@ -1,16 +1,51 @@
 package collector
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type backupCollector struct {
-	backupRepos     []BackupRepository
-	backupSize      *prometheus.Desc
-	backupTimestamp *prometheus.Desc
+	backupRepos       []ContextBackupRepository
+	options           Options
+	mutex             sync.RWMutex
+	states            map[string]*repositoryState
+	sizeWindows       map[string]*sizeWindow
+	groupMembers      map[string][]ContextBackupRepository
+	backupSize        *prometheus.Desc
+	backupTimestamp   *prometheus.Desc
+	snapshotTimestamp *prometheus.Desc
+	snapshotSize      *prometheus.Desc
+	scrapeSuccess     *prometheus.Desc
+	scrapeDuration    *prometheus.Desc
+	scrapeError       *prometheus.Desc
+	collectionAge     *prometheus.Desc
+	snapshotCount     *prometheus.Desc
+	oldestSnapshotAge *prometheus.Desc
+	repositorySize    *prometheus.Desc
+	retentionOk       *prometheus.Desc
+	retentionMissing  *prometheus.Desc
+	sizeBaseline      *prometheus.Desc
+	sizeDeviation     *prometheus.Desc
+	sizeAnomaly       *prometheus.Desc
+	nextExpected      *prometheus.Desc
+	overdue           *prometheus.Desc
+}
+
+// Represents the global settings of the collector
+type Options struct {
+	// Bounds each refresh of the repositories, a zero value disables it
+	Timeout time.Duration
+	// Time between the refreshes of the repositories, defaults to DefaultInterval
+	Interval time.Duration
+	// Also exports the deprecated backup_size and backup_timestamp metrics,
+	// meant to be enabled while dashboards migrate to the new ones
+	LegacyMetrics bool
 }
 
 // Represents the informations about the snapshot
@@ -21,9 +56,32 @@ type BackupSnapshot struct {
 	DateString string
 	// The snapshot size in bytes
 	Size float64
+	// The snapshot tags, when supported by the repository
+	Tags []string
+	// The host the snapshot was taken from, when supported by the repository
+	Host string
+	// The paths saved by the snapshot, when supported by the repository
+	Paths []string
+	// Repository specific measurements about the snapshot
+	Metrics []Metric
+}
+
+// Represents a repository specific measurement, exported along with
+// the backupAlias and repositoryType labels
+type Metric struct {
+	// The metric name, e.g. backup_last_snapshot_errors
+	Name string
+	// The metric description, it must not change between reports
+	Help string
+	// Additional labels, the same names must be used on every report
+	Labels map[string]string
+	// The metric value
+	Value float64
 }
 
-// Represents the informations about the backup repositories
+// Represents the informations about the backup repositories.
+// New repositories should implement ContextBackupRepository instead,
+// existing implementations can be wrapped with NewContextAdapter.
 type BackupRepository interface {
 	// Returns the alias of the repository
 	AliasName() string
@@ -31,19 +89,202 @@ type BackupRepository interface {
 	LatestSnapshot() (*BackupSnapshot, error)
 }
 
+// Represents the informations about the backup repositories, honoring the
+// cancellation and deadline of the scrape carried by the context
+type ContextBackupRepository interface {
+	// Returns the alias of the repository
+	AliasName() string
+	// Returns the informations about the latest snapshot of the repository
+	LatestSnapshot(ctx context.Context) (*BackupSnapshot, error)
+}
+
+// Implemented by the repositories able to list all their snapshots
+type SnapshotLister interface {
+	// Returns the informations about all the snapshots of the repository
+	Snapshots(ctx context.Context) ([]*BackupSnapshot, error)
+}
+
+// Implemented by the repositories able to report the space they use,
+// which may be less than the sum of their snapshots when data is deduplicated
+type RepositorySizer interface {
+	// Returns the size of the repository in bytes
+	RepositorySize(ctx context.Context) (float64, error)
+}
+
+// Implemented by the repositories retrieving their latest snapshot, their
+// snapshots and their size from a single listing. The collector then asks
+// for a report once per refresh instead of using each capability on its own.
+type RepositoryReporter interface {
+	// Returns the report of the repository, ErrSnapshotNotFound when there is no snapshot
+	Report(ctx context.Context) (*RepositoryReport, error)
+}
+
+// Represents the outcome of a single listing of the repository
+type RepositoryReport struct {
+	// The latest snapshot
+	Latest *BackupSnapshot
+	// All the snapshots, nil when the repository cannot list them
+	Snapshots []*BackupSnapshot
+	// The space used by the repository, nil when not reported
+	Size *float64
+}
+
+// Implemented by the repositories holding several independent backups, e.g.
+// a repository shared by many hosts. Each member is refreshed and exported
+// as a repository of its own, the group itself is only reported when its
+// members cannot be listed.
+type RepositoryGroup interface {
+	// Returns the repositories currently in the group, their aliases must be unique
+	Members(ctx context.Context) ([]ContextBackupRepository, error)
+}
+
+// Represents the collection settings shared by every kind of repository.
+// Repositories embed it so the settings can be configured next to the
+// repository specific ones.
+type RepositoryOptions struct {
+	// Maximum time to wait for the repository on each refresh, it is
+	// bounded by the global timeout
+	Timeout time.Duration
+	// Time between the refreshes of the repository, overrides the global interval
+	Interval time.Duration
+	// The snapshots the repository must keep, only checked when the
+	// repository can list its snapshots
+	Retention RetentionPolicy
+	// The thresholds flagging the size of the latest snapshot as anomalous
+	SizeAnomaly AnomalyOptions `mapstructure:"size_anomaly"`
+	// When new snapshots are expected on the repository
+	Schedule ScheduleOptions
+}
+
+// Returns the collection settings of the repository
+func (o *RepositoryOptions) Options() *RepositoryOptions {
+	return o
+}
+
+type configurableRepository interface {
+	Options() *RepositoryOptions
+}
+
+// Implemented by the repositories checking their own settings
+type validatingRepository interface {
+	Validate() error
+}
+
+// Returns an error when the settings of the repository are invalid, so they
+// are rejected on startup rather than on each refresh
+func ValidateRepository(repo ContextBackupRepository) error {
+	if err := repositoryOptions(repo).Schedule.validate(); err != nil {
+		return fmt.Errorf("invalid schedule for %s: %s", repo.AliasName(), err.Error())
+	}
+	if r, ok := repo.(validatingRepository); ok {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("invalid settings for %s: %s", repo.AliasName(), err.Error())
+		}
+	}
+	return nil
+}
+
+// Implemented by the repositories to report which kind of backup
+// they hold, e.g. restic
+type typedRepository interface {
+	TypeName() string
+}
+
+// Returns the repository type label, "unknown" when not reported
+func repositoryType(repo ContextBackupRepository) string {
+	if r, ok := repo.(typedRepository); ok {
+		return r.TypeName()
+	}
+	return "unknown"
+}
+
 //You must create a constructor for you collector that
-//initializes every descriptor and returns a pointer to the collector
-func NewBackupCollector(repos []BackupRepository) *backupCollector {
-	labels := []string{"snapshotName", "backupAlias", "creationDate"}
+//initializes every descriptor and returns a pointer to the collector.
+//The repositories are only queried once Start is called.
+func NewBackupCollector(repos []ContextBackupRepository, options Options) *backupCollector {
+	legacyLabels := []string{"snapshotName", "backupAlias", "creationDate"}
+	labels := []string{"backupAlias", "repositoryType"}
+
+	if options.Interval <= 0 {
+		options.Interval = DefaultInterval
+	}
 
 	return &backupCollector{
-		backupRepos: repos,
+		backupRepos:  repos,
+		options:      options,
+		states:       make(map[string]*repositoryState),
+		sizeWindows:  make(map[string]*sizeWindow),
+		groupMembers: make(map[string][]ContextBackupRepository),
 		backupSize: prometheus.NewDesc("backup_size",
-			"The size of the backup on the repository",
-			labels, nil,
+			"Deprecated, use backup_last_snapshot_size_bytes. The size of the backup on the repository",
+			legacyLabels, nil,
 		),
 		backupTimestamp: prometheus.NewDesc("backup_timestamp",
-			"The minutes elapsed since last backup on the repository",
+			"Deprecated, use backup_last_snapshot_timestamp_seconds. The minutes elapsed since last backup on the repository",
+			legacyLabels, nil,
+		),
+		snapshotTimestamp: prometheus.NewDesc("backup_last_snapshot_timestamp_seconds",
+			"The creation time of the latest snapshot on the repository, as a Unix timestamp",
+			labels, nil,
+		),
+		snapshotSize: prometheus.NewDesc("backup_last_snapshot_size_bytes",
+			"The size of the latest snapshot on the repository",
+			labels, nil,
+		),
+		scrapeSuccess: prometheus.NewDesc("backup_scrape_success",
+			"Whether the latest snapshot of the repository could be retrieved",
+			[]string{"backupAlias"}, nil,
+		),
+		scrapeDuration: prometheus.NewDesc("backup_scrape_duration_seconds",
+			"The time spent retrieving the latest snapshot of the repository",
+			[]string{"backupAlias"}, nil,
+		),
+		scrapeError: prometheus.NewDesc("backup_scrape_error",
+			"Set when the latest snapshot of the repository could not be retrieved, with the reason of the failure",
+			[]string{"backupAlias", "reason"}, nil,
+		),
+		collectionAge: prometheus.NewDesc("backup_collection_age_seconds",
+			"The time elapsed since the repository was last refreshed",
+			[]string{"backupAlias"}, nil,
+		),
+		snapshotCount: prometheus.NewDesc("backup_snapshot_count",
+			"The number of snapshots on the repository",
+			labels, nil,
+		),
+		oldestSnapshotAge: prometheus.NewDesc("backup_oldest_snapshot_age_seconds",
+			"The time elapsed since the oldest snapshot on the repository was created",
+			labels, nil,
+		),
+		repositorySize: prometheus.NewDesc("backup_repository_size_bytes",
+			"The space used by the repository",
+			labels, nil,
+		),
+		retentionOk: prometheus.NewDesc("backup_retention_compliant",
+			"Whether the snapshots of the repository satisfy its retention policy",
+			labels, nil,
+		),
+		retentionMissing: prometheus.NewDesc("backup_retention_missing_bucket",
+			"Set for each period required by the retention policy with no snapshot, e.g. period weekly and bucket 2018-W37",
+			[]string{"backupAlias", "repositoryType", "period", "bucket"}, nil,
+		),
+		sizeBaseline: prometheus.NewDesc("backup_size_baseline_bytes",
+			"The mean size of the snapshots preceding the latest one",
+			labels, nil,
+		),
+		sizeDeviation: prometheus.NewDesc("backup_size_deviation_ratio",
+			"The relative difference between the size of the latest snapshot and the baseline, e.g. -0.9 when it shrank by 90%",
+			labels, nil,
+		),
+		sizeAnomaly: prometheus.NewDesc("backup_size_anomaly",
+			"Whether the size of the latest snapshot deviates from the baseline beyond the configured thresholds",
+			labels, nil,
+		),
+		nextExpected: prometheus.NewDesc("backup_next_expected_timestamp_seconds",
+			"The time the next snapshot is expected according to the repository schedule, as a Unix timestamp",
+			labels, nil,
+		),
+		overdue: prometheus.NewDesc("backup_overdue",
+			"Whether the next snapshot is late according to the repository schedule and its grace period",
 			labels, nil,
 		),
 	}
@@ -53,34 +294,133 @@ func NewBackupCollector(repos []BackupRepository) *backupCollector {
 //It essentially writes all descriptors to the prometheus desc channel.
 func (collector *backupCollector) Describe(ch chan<- *prometheus.Desc) {
 
-	//Update this section with the each metric you create for a given collector
-	ch <- collector.backupSize
-	ch <- collector.backupTimestamp
+	//Update this section with the each metric you create for a given collector.
+	//Repository specific metrics are not known upfront and are left out.
+	if collector.options.LegacyMetrics {
+		ch <- collector.backupSize
+		ch <- collector.backupTimestamp
+	}
+	ch <- collector.snapshotTimestamp
+	ch <- collector.snapshotSize
+	ch <- collector.scrapeSuccess
+	ch <- collector.scrapeDuration
+	ch <- collector.scrapeError
+	ch <- collector.collectionAge
+	ch <- collector.snapshotCount
+	ch <- collector.oldestSnapshotAge
+	ch <- collector.repositorySize
+	ch <- collector.retentionOk
+	ch <- collector.retentionMissing
+	ch <- collector.sizeBaseline
+	ch <- collector.sizeDeviation
+	ch <- collector.sizeAnomaly
+	ch <- collector.nextExpected
+	ch <- collector.overdue
+}
+
+// Returns the prometheus metric holding the repository specific measurement
+func (m Metric) constMetric(alias, repositoryType string) prometheus.Metric {
+	labels := []string{"backupAlias", "repositoryType"}
+	values := []string{alias, repositoryType}
+
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		labels = append(labels, name)
+		values = append(values, m.Labels[name])
+	}
+
+	desc := prometheus.NewDesc(m.Name, m.Help, labels, nil)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, m.Value, values...)
 }
 
-//Collect implements required collect function for all promehteus collectors
+//Collect implements required collect function for all promehteus collectors.
+//It only reports the results cached by the latest refresh of each repository,
+//repositories that were not refreshed yet are left out.
 func (collector *backupCollector) Collect(ch chan<- prometheus.Metric) {
+	collector.mutex.RLock()
+	defer collector.mutex.RUnlock()
 
 	for _, repo := range collector.backupRepos {
-		snapshot, err := repo.LatestSnapshot()
-		log.Println("Collect - ")
-		log.Println(snapshot)
+		repos := append([]ContextBackupRepository{repo}, collector.groupMembers[repo.AliasName()]...)
+		for _, repo := range repos {
+			state, ok := collector.states[repo.AliasName()]
+			if !ok {
+				continue
+			}
+			collector.collectState(repo, state, ch)
+		}
+	}
+}
+
+func (collector *backupCollector) collectState(repo ContextBackupRepository, state *repositoryState, ch chan<- prometheus.Metric) {
+	alias := repo.AliasName()
+	ch <- prometheus.MustNewConstMetric(collector.scrapeDuration, prometheus.GaugeValue, state.duration.Seconds(), alias)
+	ch <- prometheus.MustNewConstMetric(collector.collectionAge, prometheus.GaugeValue, time.Since(state.collectedAt).Seconds(), alias)
+
+	if state.reason != "" {
+		ch <- prometheus.MustNewConstMetric(collector.scrapeSuccess, prometheus.GaugeValue, 0, alias)
+		ch <- prometheus.MustNewConstMetric(collector.scrapeError, prometheus.GaugeValue, 1, alias, state.reason)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(collector.scrapeSuccess, prometheus.GaugeValue, 1, alias)
+
+	snapshot := state.snapshot
+	ch <- prometheus.MustNewConstMetric(collector.snapshotTimestamp, prometheus.GaugeValue, float64(state.creationDate.Unix()), alias, repositoryType(repo))
+	ch <- prometheus.MustNewConstMetric(collector.snapshotSize, prometheus.GaugeValue, snapshot.Size, alias, repositoryType(repo))
 
-		if err != nil {
-			log.Printf("failed to fetch latest snapshot for %v: %s", repo.AliasName(), err.Error())
-			continue
+	if state.history != nil {
+		ch <- prometheus.MustNewConstMetric(collector.snapshotCount, prometheus.GaugeValue, float64(len(state.history)), alias, repositoryType(repo))
+	}
+	if len(state.history) > 0 {
+		ch <- prometheus.MustNewConstMetric(collector.oldestSnapshotAge, prometheus.GaugeValue, time.Since(state.oldestDate).Seconds(), alias, repositoryType(repo))
+	}
+	if state.repositorySize != nil {
+		ch <- prometheus.MustNewConstMetric(collector.repositorySize, prometheus.GaugeValue, *state.repositorySize, alias, repositoryType(repo))
+	}
+
+	if state.retentionChecked {
+		compliant := 0.0
+		if len(state.missingBuckets) == 0 {
+			compliant = 1
 		}
+		ch <- prometheus.MustNewConstMetric(collector.retentionOk, prometheus.GaugeValue, compliant, alias, repositoryType(repo))
+		for _, missing := range state.missingBuckets {
+			ch <- prometheus.MustNewConstMetric(collector.retentionMissing, prometheus.GaugeValue, 1, alias, repositoryType(repo), missing.period, missing.bucket)
+		}
+	}
 
-		creationDate, err := time.Parse(time.UnixDate, snapshot.DateString)
-		if err != nil {
-			log.Printf("failed parse time %v: %s", repo.AliasName(), err.Error())
-			continue
+	if state.sizeChecked {
+		anomaly := 0.0
+		if state.sizeAnomaly {
+			anomaly = 1
 		}
+		ch <- prometheus.MustNewConstMetric(collector.sizeBaseline, prometheus.GaugeValue, state.sizeBaseline, alias, repositoryType(repo))
+		ch <- prometheus.MustNewConstMetric(collector.sizeDeviation, prometheus.GaugeValue, state.sizeDeviation, alias, repositoryType(repo))
+		ch <- prometheus.MustNewConstMetric(collector.sizeAnomaly, prometheus.GaugeValue, anomaly, alias, repositoryType(repo))
+	}
+
+	if !state.nextExpected.IsZero() {
+		overdue := 0.0
+		if repositoryOptions(repo).Schedule.overdue(state.nextExpected, time.Now()) {
+			overdue = 1
+		}
+		ch <- prometheus.MustNewConstMetric(collector.nextExpected, prometheus.GaugeValue, float64(state.nextExpected.Unix()), alias, repositoryType(repo))
+		ch <- prometheus.MustNewConstMetric(collector.overdue, prometheus.GaugeValue, overdue, alias, repositoryType(repo))
+	}
+
+	for _, metric := range snapshot.Metrics {
+		ch <- metric.constMetric(alias, repositoryType(repo))
+	}
 
-		sizeMetric := prometheus.MustNewConstMetric(collector.backupSize, prometheus.GaugeValue, snapshot.Size, snapshot.Name, repo.AliasName(), snapshot.DateString)
-		timestampMetric := prometheus.MustNewConstMetric(collector.backupTimestamp, prometheus.GaugeValue, time.Since(creationDate).Minutes(), snapshot.Name, repo.AliasName(), snapshot.DateString)
+	if collector.options.LegacyMetrics {
+		sizeMetric := prometheus.MustNewConstMetric(collector.backupSize, prometheus.GaugeValue, snapshot.Size, snapshot.Name, alias, snapshot.DateString)
+		timestampMetric := prometheus.MustNewConstMetric(collector.backupTimestamp, prometheus.GaugeValue, time.Since(state.creationDate).Minutes(), snapshot.Name, alias, snapshot.DateString)
 
-		ch <- prometheus.NewMetricWithTimestamp(creationDate, sizeMetric)
+		ch <- prometheus.NewMetricWithTimestamp(state.creationDate, sizeMetric)
 		ch <- timestampMetric
 	}
 }
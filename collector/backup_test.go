@@ -0,0 +1,455 @@
+package collector
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type mockRepository struct {
+	RepositoryOptions
+	alias string
+	delay time.Duration
+	err   error
+	calls int32
+}
+
+func (m *mockRepository) AliasName() string {
+	return m.alias
+}
+
+func (m *mockRepository) LatestSnapshot() (*BackupSnapshot, error) {
+	atomic.AddInt32(&m.calls, 1)
+	time.Sleep(m.delay)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &BackupSnapshot{
+		Name:       m.alias + "-snapshot",
+		DateString: time.Now().UTC().Format(time.UnixDate),
+		Size:       1024,
+	}, nil
+}
+
+// Refreshes all the repositories concurrently and waits for them
+func (collector *backupCollector) refreshAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, repo := range collector.backupRepos {
+		wg.Add(1)
+		go func(repo ContextBackupRepository) {
+			defer wg.Done()
+			collector.refresh(ctx, repo)
+		}(repo)
+	}
+	wg.Wait()
+}
+
+func collect(c prometheus.Collector) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// Returns the metrics with the given name and backupAlias label
+func findMetrics(t *testing.T, metrics []prometheus.Metric, name, alias string) []*dto.Metric {
+	var found []*dto.Metric
+	for _, m := range metrics {
+		if !strings.Contains(m.Desc().String(), `fqName: "`+name+`"`) {
+			continue
+		}
+		metric := &dto.Metric{}
+		if err := m.Write(metric); err != nil {
+			t.Fatal(err)
+		}
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "backupAlias" && label.GetValue() == alias {
+				found = append(found, metric)
+			}
+		}
+	}
+	return found
+}
+
+func labelValue(metric *dto.Metric, name string) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestCollectTimeout(t *testing.T) {
+	t.Log("Testing that a hung repository does not block the others")
+	repos := []ContextBackupRepository{
+		NewContextAdapter(&mockRepository{alias: "fast"}),
+		NewContextAdapter(&mockRepository{alias: "hung", delay: time.Minute}),
+	}
+	c := NewBackupCollector(repos, Options{Timeout: 200 * time.Millisecond})
+
+	start := time.Now()
+	c.refreshAll(context.Background())
+	metrics := collect(c)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Collect took %s, expected it to stop at the timeout", elapsed)
+	}
+
+	if found := findMetrics(t, metrics, "backup_last_snapshot_size_bytes", "fast"); len(found) != 1 {
+		t.Errorf("Expected the size of the fast repository but got %d metrics", len(found))
+	}
+
+	found := findMetrics(t, metrics, "backup_scrape_error", "hung")
+	if len(found) != 1 || labelValue(found[0], "reason") != ReasonTimeout {
+		t.Errorf("Expected a %s error for the hung repository but got %v", ReasonTimeout, found)
+	}
+}
+
+func TestCollectRepositoryTimeout(t *testing.T) {
+	t.Log("Testing a per-repository timeout shorter than the global one")
+	slow := &mockRepository{alias: "slow", delay: time.Minute}
+	slow.Timeout = 100 * time.Millisecond
+	c := NewBackupCollector([]ContextBackupRepository{
+		NewContextAdapter(slow),
+		NewContextAdapter(&mockRepository{alias: "fast"}),
+	}, Options{Timeout: time.Minute})
+
+	start := time.Now()
+	c.refreshAll(context.Background())
+	metrics := collect(c)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Collect took %s, expected it to stop at the repository timeout", elapsed)
+	}
+
+	if found := findMetrics(t, metrics, "backup_last_snapshot_size_bytes", "fast"); len(found) != 1 {
+		t.Errorf("Expected the size of the fast repository but got %d metrics", len(found))
+	}
+}
+
+func TestCollectScrapeErrors(t *testing.T) {
+	t.Log("Testing the scrape metrics of failing repositories")
+	c := NewBackupCollector([]ContextBackupRepository{
+		NewContextAdapter(&mockRepository{alias: "ok"}),
+		NewContextAdapter(&mockRepository{alias: "missing", err: ErrSnapshotNotFound}),
+		NewContextAdapter(&mockRepository{alias: "denied", err: ErrAuthentication}),
+	}, Options{Timeout: time.Minute})
+	c.refreshAll(context.Background())
+	metrics := collect(c)
+
+	expected := map[string]float64{"ok": 1, "missing": 0, "denied": 0}
+	for alias, value := range expected {
+		found := findMetrics(t, metrics, "backup_scrape_success", alias)
+		if len(found) != 1 || found[0].GetGauge().GetValue() != value {
+			t.Errorf("Expected backup_scrape_success %v for %s but got %v", value, alias, found)
+		}
+		if found := findMetrics(t, metrics, "backup_scrape_duration_seconds", alias); len(found) != 1 {
+			t.Errorf("Expected backup_scrape_duration_seconds for %s but got %v", alias, found)
+		}
+	}
+
+	reasons := map[string]string{"missing": ReasonNotFound, "denied": ReasonAuth}
+	for alias, reason := range reasons {
+		found := findMetrics(t, metrics, "backup_scrape_error", alias)
+		if len(found) != 1 || labelValue(found[0], "reason") != reason {
+			t.Errorf("Expected a %s error for %s but got %v", reason, alias, found)
+		}
+	}
+
+	if found := findMetrics(t, metrics, "backup_scrape_error", "ok"); len(found) != 0 {
+		t.Errorf("Expected no error for the healthy repository but got %v", found)
+	}
+}
+
+func TestCollectLegacyMetrics(t *testing.T) {
+	t.Log("Testing the migration mode exporting the deprecated metrics")
+	repos := []ContextBackupRepository{NewContextAdapter(&mockRepository{alias: "repo"})}
+
+	c := NewBackupCollector(repos, Options{})
+	c.refreshAll(context.Background())
+	metrics := collect(c)
+	if found := findMetrics(t, metrics, "backup_timestamp", "repo"); len(found) != 0 {
+		t.Errorf("Expected no backup_timestamp without the migration mode but got %v", found)
+	}
+
+	found := findMetrics(t, metrics, "backup_last_snapshot_timestamp_seconds", "repo")
+	if len(found) != 1 {
+		t.Fatalf("Expected backup_last_snapshot_timestamp_seconds but got %v", found)
+	}
+	if labelValue(found[0], "repositoryType") != "unknown" {
+		t.Errorf("Expected repositoryType unknown but got %s", labelValue(found[0], "repositoryType"))
+	}
+	if elapsed := time.Now().Unix() - int64(found[0].GetGauge().GetValue()); elapsed < 0 || elapsed > 60 {
+		t.Errorf("Expected a recent Unix timestamp but got %v", found[0].GetGauge().GetValue())
+	}
+
+	c = NewBackupCollector(repos, Options{LegacyMetrics: true})
+	c.refreshAll(context.Background())
+	metrics = collect(c)
+	for _, name := range []string{"backup_size", "backup_timestamp", "backup_last_snapshot_timestamp_seconds"} {
+		if found := findMetrics(t, metrics, name, "repo"); len(found) != 1 {
+			t.Errorf("Expected %s in the migration mode but got %v", name, found)
+		}
+	}
+}
+
+func TestCollectFromCache(t *testing.T) {
+	t.Log("Testing that scrapes are served from the background refreshes")
+	repo := &mockRepository{alias: "repo"}
+	c := NewBackupCollector([]ContextBackupRepository{NewContextAdapter(repo)}, Options{Interval: time.Hour})
+
+	if metrics := collect(c); len(metrics) != 0 {
+		t.Errorf("Expected no metrics before the first refresh but got %d", len(metrics))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&repo.calls) == 0 || len(collect(c)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The repository was not refreshed in background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		metrics := collect(c)
+		if found := findMetrics(t, metrics, "backup_collection_age_seconds", "repo"); len(found) != 1 {
+			t.Errorf("Expected backup_collection_age_seconds but got %v", found)
+		}
+	}
+	if calls := atomic.LoadInt32(&repo.calls); calls != 1 {
+		t.Errorf("Expected a single call to the repository but got %d", calls)
+	}
+}
+
+type mockListerRepository struct {
+	mockRepository
+	history []*BackupSnapshot
+}
+
+func (m *mockListerRepository) LatestSnapshot(ctx context.Context) (*BackupSnapshot, error) {
+	return m.history[len(m.history)-1], nil
+}
+
+func (m *mockListerRepository) Snapshots(ctx context.Context) ([]*BackupSnapshot, error) {
+	return m.history, nil
+}
+
+func (m *mockListerRepository) RepositorySize(ctx context.Context) (float64, error) {
+	return 4096, nil
+}
+
+func TestCollectHistory(t *testing.T) {
+	t.Log("Testing the metrics of repositories listing their snapshots")
+	now := time.Now().UTC()
+	repo := &mockListerRepository{
+		mockRepository: mockRepository{alias: "repo"},
+		history: []*BackupSnapshot{
+			{Name: "first", DateString: now.Add(-48 * time.Hour).Format(time.UnixDate)},
+			{Name: "second", DateString: now.Add(-24 * time.Hour).Format(time.UnixDate)},
+			{Name: "third", DateString: now.Format(time.UnixDate)},
+		},
+	}
+	c := NewBackupCollector([]ContextBackupRepository{repo}, Options{})
+	c.refreshAll(context.Background())
+	metrics := collect(c)
+
+	found := findMetrics(t, metrics, "backup_snapshot_count", "repo")
+	if len(found) != 1 || found[0].GetGauge().GetValue() != 3 {
+		t.Errorf("Expected 3 snapshots but got %v", found)
+	}
+
+	found = findMetrics(t, metrics, "backup_oldest_snapshot_age_seconds", "repo")
+	if len(found) != 1 || found[0].GetGauge().GetValue() < (48*time.Hour).Seconds() {
+		t.Errorf("Expected the age of the first snapshot but got %v", found)
+	}
+
+	found = findMetrics(t, metrics, "backup_repository_size_bytes", "repo")
+	if len(found) != 1 || found[0].GetGauge().GetValue() != 4096 {
+		t.Errorf("Expected the repository size but got %v", found)
+	}
+}
+
+type mockFailingListerRepository struct {
+	mockListerRepository
+}
+
+func (m *mockFailingListerRepository) Snapshots(ctx context.Context) ([]*BackupSnapshot, error) {
+	return nil, ErrAuthentication
+}
+
+func (m *mockFailingListerRepository) RepositorySize(ctx context.Context) (float64, error) {
+	return 0, context.DeadlineExceeded
+}
+
+func TestCollectHistoryBestEffort(t *testing.T) {
+	t.Log("Testing that failing to list the snapshots keeps the latest snapshot")
+	repo := &mockFailingListerRepository{mockListerRepository{
+		mockRepository: mockRepository{alias: "repo"},
+		history:        []*BackupSnapshot{{Name: "latest", DateString: time.Now().UTC().Format(time.UnixDate), Size: 512}},
+	}}
+	repo.Retention.Daily = 7
+	c := NewBackupCollector([]ContextBackupRepository{repo}, Options{})
+	c.refreshAll(context.Background())
+	metrics := collect(c)
+
+	found := findMetrics(t, metrics, "backup_scrape_success", "repo")
+	if len(found) != 1 || found[0].GetGauge().GetValue() != 1 {
+		t.Errorf("Expected a successful refresh but got %v", found)
+	}
+	if found := findMetrics(t, metrics, "backup_last_snapshot_size_bytes", "repo"); len(found) != 1 {
+		t.Errorf("Expected the size of the latest snapshot but got %v", found)
+	}
+	for _, name := range []string{"backup_snapshot_count", "backup_repository_size_bytes", "backup_retention_compliant"} {
+		if found := findMetrics(t, metrics, name, "repo"); len(found) != 0 {
+			t.Errorf("Expected no %s but got %v", name, found)
+		}
+	}
+}
+
+type mockReporterRepository struct {
+	mockListerRepository
+	reports int32
+}
+
+func (m *mockReporterRepository) Report(ctx context.Context) (*RepositoryReport, error) {
+	atomic.AddInt32(&m.reports, 1)
+	size := float64(2048)
+	return &RepositoryReport{Latest: m.history[len(m.history)-1], Snapshots: m.history, Size: &size}, nil
+}
+
+func TestCollectReport(t *testing.T) {
+	t.Log("Testing that the repositories listing once are only asked for a report")
+	now := time.Now().UTC()
+	repo := &mockReporterRepository{mockListerRepository: mockListerRepository{
+		mockRepository: mockRepository{alias: "repo"},
+		history: []*BackupSnapshot{
+			{Name: "first", DateString: now.Add(-24 * time.Hour).Format(time.UnixDate)},
+			{Name: "second", DateString: now.Format(time.UnixDate)},
+		},
+	}}
+	c := NewBackupCollector([]ContextBackupRepository{repo}, Options{})
+	c.refreshAll(context.Background())
+	metrics := collect(c)
+
+	if reports := atomic.LoadInt32(&repo.reports); reports != 1 {
+		t.Errorf("Expected a single report but got %d", reports)
+	}
+	found := findMetrics(t, metrics, "backup_snapshot_count", "repo")
+	if len(found) != 1 || found[0].GetGauge().GetValue() != 2 {
+		t.Errorf("Expected 2 snapshots but got %v", found)
+	}
+	found = findMetrics(t, metrics, "backup_repository_size_bytes", "repo")
+	if len(found) != 1 || found[0].GetGauge().GetValue() != 2048 {
+		t.Errorf("Expected the size of the report but got %v", found)
+	}
+}
+
+func TestCollectRepositoryMetrics(t *testing.T) {
+	t.Log("Testing the repository specific metrics of the latest snapshot")
+	repo := &mockListerRepository{
+		mockRepository: mockRepository{alias: "repo"},
+		history: []*BackupSnapshot{{
+			Name:       "latest",
+			DateString: time.Now().UTC().Format(time.UnixDate),
+			Metrics: []Metric{
+				{Name: "backup_last_snapshot_errors", Help: "Errors", Value: 2},
+				{Name: "backup_custom_state", Help: "State", Labels: map[string]string{"state": "SUCCESS"}, Value: 1},
+			},
+		}},
+	}
+	c := NewBackupCollector([]ContextBackupRepository{repo}, Options{})
+	c.refreshAll(context.Background())
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	values := make(map[string]*dto.Metric)
+	for _, family := range families {
+		values[family.GetName()] = family.GetMetric()[0]
+	}
+
+	if m := values["backup_last_snapshot_errors"]; m == nil || m.GetGauge().GetValue() != 2 {
+		t.Errorf("Expected backup_last_snapshot_errors 2 but got %v", m)
+	}
+	if m := values["backup_custom_state"]; m == nil || labelValue(m, "state") != "SUCCESS" || labelValue(m, "backupAlias") != "repo" {
+		t.Errorf("Expected backup_custom_state with its labels but got %v", m)
+	}
+}
+
+type mockGroupRepository struct {
+	mockRepository
+	members []ContextBackupRepository
+}
+
+func (m *mockGroupRepository) LatestSnapshot(ctx context.Context) (*BackupSnapshot, error) {
+	return nil, ErrSnapshotNotFound
+}
+
+func (m *mockGroupRepository) Members(ctx context.Context) ([]ContextBackupRepository, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.members, nil
+}
+
+func TestCollectGroup(t *testing.T) {
+	t.Log("Testing that the members of a group are exported as repositories of their own")
+	group := &mockGroupRepository{
+		mockRepository: mockRepository{alias: "shared"},
+		members: []ContextBackupRepository{
+			NewContextAdapter(&mockRepository{alias: "shared/host1"}),
+			NewContextAdapter(&mockRepository{alias: "shared/host2"}),
+		},
+	}
+	c := NewBackupCollector([]ContextBackupRepository{group}, Options{})
+	c.refreshAll(context.Background())
+	metrics := collect(c)
+
+	for _, alias := range []string{"shared/host1", "shared/host2"} {
+		if found := findMetrics(t, metrics, "backup_last_snapshot_size_bytes", alias); len(found) != 1 {
+			t.Errorf("Expected the size of %s but got %v", alias, found)
+		}
+	}
+	if found := findMetrics(t, metrics, "backup_scrape_success", "shared"); len(found) != 0 {
+		t.Errorf("Expected no metrics for the group itself but got %v", found)
+	}
+
+	group.err = ErrAuthentication
+	c.refreshAll(context.Background())
+	metrics = collect(c)
+	found := findMetrics(t, metrics, "backup_scrape_error", "shared")
+	if len(found) != 1 || labelValue(found[0], "reason") != ReasonAuth {
+		t.Errorf("Expected a %s error for the group but got %v", ReasonAuth, found)
+	}
+
+	group.err = nil
+	group.members = group.members[:1]
+	c.refreshAll(context.Background())
+	metrics = collect(c)
+	if found := findMetrics(t, metrics, "backup_scrape_success", "shared/host2"); len(found) != 0 {
+		t.Errorf("Expected no metrics for the member gone from the group but got %v", found)
+	}
+	if found := findMetrics(t, metrics, "backup_scrape_success", "shared"); len(found) != 0 {
+		t.Errorf("Expected the error of the group to be cleared but got %v", found)
+	}
+}
@@ -1,5 +1,57 @@
 package collector
 
-import "errors"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
 
 var ErrSnapshotNotFound = errors.New("no snapshot found")
+
+// Returned by the repositories when their credentials are rejected
+var ErrAuthentication = errors.New("authentication failed")
+
+// Represents a failure decoding the informations returned by a repository
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return "parse error: " + e.Err.Error()
+}
+
+// Reasons reported by the backup_scrape_error metric
+const (
+	ReasonNotFound = "not_found"
+	ReasonTimeout  = "timeout"
+	ReasonAuth     = "auth"
+	ReasonParse    = "parse_error"
+	ReasonUnknown  = "unknown"
+)
+
+type timeoutError interface {
+	Timeout() bool
+}
+
+// Returns the reason label of an error returned by a repository
+func errorReason(err error) string {
+	switch err {
+	case ErrSnapshotNotFound:
+		return ReasonNotFound
+	case ErrAuthentication:
+		return ReasonAuth
+	case context.DeadlineExceeded, context.Canceled:
+		return ReasonTimeout
+	}
+
+	switch e := err.(type) {
+	case *ParseError, *json.SyntaxError, *json.UnmarshalTypeError, *time.ParseError:
+		return ReasonParse
+	case timeoutError:
+		if e.Timeout() {
+			return ReasonTimeout
+		}
+	}
+	return ReasonUnknown
+}
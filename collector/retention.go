@@ -0,0 +1,118 @@
+package collector
+
+import (
+	"fmt"
+	"time"
+)
+
+// Represents how many snapshots the repository must keep for each period,
+// e.g. keep 7 daily, 4 weekly and 12 monthly. Periods are checked in UTC.
+type RetentionPolicy struct {
+	Hourly,
+	Daily,
+	Weekly,
+	Monthly,
+	Yearly int
+}
+
+// Represents a period required by the retention policy with no snapshot
+type missingBucket struct {
+	// The kind of period, e.g. weekly
+	period string
+	// The period itself, e.g. 2018-W37
+	bucket string
+}
+
+type retentionPeriod struct {
+	name  string
+	count int
+	// Returns the start of the period holding t
+	start func(t time.Time) time.Time
+	// Returns the start of the period preceding the one starting at t
+	previous func(t time.Time) time.Time
+	// Returns the name of the period starting at t
+	format func(t time.Time) string
+}
+
+// Returns whether the policy requires any snapshot
+func (p RetentionPolicy) enabled() bool {
+	return p.Hourly > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.Yearly > 0
+}
+
+func (p RetentionPolicy) periods() []retentionPeriod {
+	return []retentionPeriod{
+		{
+			name:     "hourly",
+			count:    p.Hourly,
+			start:    func(t time.Time) time.Time { return t.Truncate(time.Hour) },
+			previous: func(t time.Time) time.Time { return t.Add(-time.Hour) },
+			format:   func(t time.Time) string { return t.Format("2006-01-02T15") },
+		},
+		{
+			name:     "daily",
+			count:    p.Daily,
+			start:    startOfDay,
+			previous: func(t time.Time) time.Time { return t.AddDate(0, 0, -1) },
+			format:   func(t time.Time) string { return t.Format("2006-01-02") },
+		},
+		{
+			name:  "weekly",
+			count: p.Weekly,
+			start: func(t time.Time) time.Time {
+				// ISO weeks start on Monday
+				weekday := (int(t.Weekday()) + 6) % 7
+				return startOfDay(t).AddDate(0, 0, -weekday)
+			},
+			previous: func(t time.Time) time.Time { return t.AddDate(0, 0, -7) },
+			format: func(t time.Time) string {
+				year, week := t.ISOWeek()
+				return fmt.Sprintf("%d-W%02d", year, week)
+			},
+		},
+		{
+			name:     "monthly",
+			count:    p.Monthly,
+			start:    func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) },
+			previous: func(t time.Time) time.Time { return t.AddDate(0, -1, 0) },
+			format:   func(t time.Time) string { return t.Format("2006-01") },
+		},
+		{
+			name:     "yearly",
+			count:    p.Yearly,
+			start:    func(t time.Time) time.Time { return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC) },
+			previous: func(t time.Time) time.Time { return t.AddDate(-1, 0, 0) },
+			format:   func(t time.Time) string { return t.Format("2006") },
+		},
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Returns the periods with no snapshot among the ones required by the policy.
+// Only complete periods are required, e.g. with 7 daily the 7 days before
+// today must have a snapshot, today is not checked as its backup may be
+// yet to run.
+func (p RetentionPolicy) missingBuckets(dates []time.Time, now time.Time) []missingBucket {
+	var missing []missingBucket
+	for _, period := range p.periods() {
+		if period.count <= 0 {
+			continue
+		}
+
+		found := make(map[string]bool)
+		for _, date := range dates {
+			found[period.format(period.start(date.UTC()))] = true
+		}
+
+		bucket := period.start(now.UTC())
+		for i := 0; i < period.count; i++ {
+			bucket = period.previous(bucket)
+			if name := period.format(bucket); !found[name] {
+				missing = append(missing, missingBucket{period.name, name})
+			}
+		}
+	}
+	return missing
+}
@@ -0,0 +1,49 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMissingBuckets(t *testing.T) {
+	// Friday, 14th of September 2018, week 37
+	now := time.Date(2018, 9, 14, 10, 0, 0, 0, time.UTC)
+
+	var dates []time.Time
+	// Daily snapshots for the previous three weeks, except for week 36
+	for day := now.AddDate(0, 0, -21); day.Before(now); day = day.AddDate(0, 0, 1) {
+		if _, week := day.ISOWeek(); week == 36 {
+			continue
+		}
+		dates = append(dates, day)
+	}
+
+	policy := RetentionPolicy{Daily: 3, Weekly: 3, Monthly: 2}
+	expected := []missingBucket{
+		{"weekly", "2018-W36"},
+		{"monthly", "2018-07"},
+	}
+
+	missing := policy.missingBuckets(dates, now)
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("Expected %v but got %v", expected, missing)
+	}
+}
+
+func TestMissingBucketsCompliant(t *testing.T) {
+	now := time.Date(2018, 9, 14, 10, 0, 0, 0, time.UTC)
+	dates := []time.Time{
+		now.Add(-24 * time.Hour),
+		now.Add(-48 * time.Hour),
+	}
+
+	policy := RetentionPolicy{Daily: 2}
+	if missing := policy.missingBuckets(dates, now); len(missing) != 0 {
+		t.Errorf("Expected no missing bucket but got %v", missing)
+	}
+
+	if !policy.enabled() || (RetentionPolicy{}).enabled() {
+		t.Errorf("Expected only the policy with a daily rule to be enabled")
+	}
+}
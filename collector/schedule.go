@@ -0,0 +1,51 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// Represents when new snapshots are expected on the repository, either
+// following the cron expression of the backup job or a fixed interval
+type ScheduleOptions struct {
+	// Standard cron expression of the backup job, e.g. "0 2 * * *",
+	// evaluated in the local time zone
+	Cron string
+	// Expected time between two snapshots, used when there is no cron expression
+	Interval time.Duration
+	// Delay tolerated after the expected time before the backup is overdue
+	Grace time.Duration
+}
+
+// Returns whether an expected schedule was configured
+func (s ScheduleOptions) enabled() bool {
+	return s.Cron != "" || s.Interval > 0
+}
+
+// Returns an error when the cron expression cannot be parsed
+func (s ScheduleOptions) validate() error {
+	if s.Cron == "" {
+		return nil
+	}
+	_, err := cron.ParseStandard(s.Cron)
+	return err
+}
+
+// Returns the time the snapshot following the one created at last is expected
+func (s ScheduleOptions) nextExpected(last time.Time) (time.Time, error) {
+	if s.Cron == "" {
+		return last.Add(s.Interval), nil
+	}
+
+	schedule, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(last.In(time.Local)), nil
+}
+
+// Returns whether the expected snapshot is later than the grace period allows
+func (s ScheduleOptions) overdue(next, now time.Time) bool {
+	return now.After(next.Add(s.Grace))
+}
@@ -0,0 +1,63 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextExpected(t *testing.T) {
+	last := time.Date(2018, 9, 12, 2, 5, 0, 0, time.Local)
+
+	schedule := ScheduleOptions{Cron: "0 2 * * *", Grace: time.Hour}
+	next, err := schedule.nextExpected(last)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := time.Date(2018, 9, 13, 2, 0, 0, 0, time.Local)
+	if !next.Equal(expected) {
+		t.Errorf("Expected %s but got %s", expected, next)
+	}
+
+	if schedule.overdue(next, expected.Add(30*time.Minute)) {
+		t.Errorf("Expected the backup not to be overdue within the grace period")
+	}
+	if !schedule.overdue(next, expected.Add(2*time.Hour)) {
+		t.Errorf("Expected the backup to be overdue after the grace period")
+	}
+}
+
+func TestNextExpectedInterval(t *testing.T) {
+	last := time.Date(2018, 9, 12, 2, 5, 0, 0, time.UTC)
+
+	schedule := ScheduleOptions{Interval: 6 * time.Hour}
+	next, err := schedule.nextExpected(last)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if expected := last.Add(6 * time.Hour); !next.Equal(expected) {
+		t.Errorf("Expected %s but got %s", expected, next)
+	}
+}
+
+func TestNextExpectedInvalidCron(t *testing.T) {
+	schedule := ScheduleOptions{Cron: "every night"}
+	if _, err := schedule.nextExpected(time.Now()); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateRepository(t *testing.T) {
+	mock := &mockRepository{alias: "repo"}
+	repo := NewContextAdapter(mock)
+	mock.Schedule.Cron = "0 2 * * *"
+	if err := ValidateRepository(repo); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	mock.Schedule.Cron = "every night"
+	if err := ValidateRepository(repo); err == nil {
+		t.Errorf("Expected an error for an invalid cron expression")
+	}
+}
@@ -0,0 +1,271 @@
+package collector
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Time between the refreshes of the repositories when not configured
+const DefaultInterval = 5 * time.Minute
+
+// Holds the outcome of the latest refresh of a repository
+type repositoryState struct {
+	// The latest snapshot, nil when the refresh failed
+	snapshot     *BackupSnapshot
+	creationDate time.Time
+	// All the snapshots, nil when the repository cannot list them
+	history      []*BackupSnapshot
+	historyDates []time.Time
+	oldestDate   time.Time
+	// Whether the retention policy was checked and the periods it misses
+	retentionChecked bool
+	missingBuckets   []missingBucket
+	// Whether the size of the latest snapshot was compared to the baseline
+	sizeChecked   bool
+	sizeBaseline  float64
+	sizeDeviation float64
+	sizeAnomaly   bool
+	// When the next snapshot is expected, zero without a schedule
+	nextExpected time.Time
+	// The space used by the repository, nil when not reported
+	repositorySize *float64
+	// The reason of the failure, empty when the refresh succeeded
+	reason      string
+	duration    time.Duration
+	collectedAt time.Time
+}
+
+// Returns the collection settings of the repository, empty if it has none
+func repositoryOptions(repo ContextBackupRepository) *RepositoryOptions {
+	if r, ok := repo.(configurableRepository); ok {
+		return r.Options()
+	}
+	return &RepositoryOptions{}
+}
+
+// Refreshes every repository in background, each one on its own interval,
+// until the context is done. The first refresh happens right away.
+func (collector *backupCollector) Start(ctx context.Context) {
+	for _, repo := range collector.backupRepos {
+		go collector.poll(ctx, repo)
+	}
+}
+
+func (collector *backupCollector) poll(ctx context.Context, repo ContextBackupRepository) {
+	interval := collector.options.Interval
+	if repoInterval := repositoryOptions(repo).Interval; repoInterval > 0 {
+		interval = repoInterval
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		collector.refresh(ctx, repo)
+		timer.Reset(interval)
+	}
+}
+
+// Bounds the context with the global and the repository timeouts
+func (collector *backupCollector) withTimeout(ctx context.Context, repo ContextBackupRepository) (context.Context, context.CancelFunc) {
+	cancels := []context.CancelFunc{}
+	if collector.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, collector.options.Timeout)
+		cancels = append(cancels, cancel)
+	}
+	if timeout := repositoryOptions(repo).Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		cancels = append(cancels, cancel)
+	}
+	return ctx, func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+// Refreshes the repository, or every member of a group
+func (collector *backupCollector) refresh(ctx context.Context, repo ContextBackupRepository) {
+	if group, ok := repo.(RepositoryGroup); ok {
+		collector.refreshGroup(ctx, repo, group)
+		return
+	}
+	collector.refreshRepository(ctx, repo)
+}
+
+// Lists the members of the group and refreshes them concurrently. The members
+// gone from the group are no longer exported.
+func (collector *backupCollector) refreshGroup(ctx context.Context, repo ContextBackupRepository, group RepositoryGroup) {
+	start := time.Now()
+	membersCtx, cancel := collector.withTimeout(ctx, repo)
+	members, err := group.Members(membersCtx)
+	cancel()
+
+	if err != nil {
+		// The members of the previous refresh are kept, so a transient
+		// failure does not reset their size baselines
+		state := &repositoryState{duration: time.Since(start), collectedAt: time.Now()}
+		state.setError(membersCtx, repo, err)
+		collector.mutex.Lock()
+		collector.states[repo.AliasName()] = state
+		collector.mutex.Unlock()
+		return
+	}
+
+	var wg sync.WaitGroup
+	current := make(map[string]bool)
+	for _, member := range members {
+		current[member.AliasName()] = true
+		wg.Add(1)
+		go func(member ContextBackupRepository) {
+			defer wg.Done()
+			collector.refreshRepository(ctx, member)
+		}(member)
+	}
+	wg.Wait()
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	delete(collector.states, repo.AliasName())
+	for _, member := range collector.groupMembers[repo.AliasName()] {
+		if !current[member.AliasName()] {
+			delete(collector.states, member.AliasName())
+			delete(collector.sizeWindows, member.AliasName())
+		}
+	}
+	collector.groupMembers[repo.AliasName()] = members
+}
+
+// Records the reason of the failure of the refresh
+func (state *repositoryState) setError(ctx context.Context, repo ContextBackupRepository, err error) {
+	state.reason = errorReason(err)
+	if ctx.Err() != nil {
+		// Backends may fail in their own way once cancelled,
+		// e.g. a killed process, so rely on the context instead
+		state.reason = ReasonTimeout
+	}
+	log.Printf("failed to collect %v (%s): %s", repo.AliasName(), state.reason, err.Error())
+}
+
+// Queries the repository for its latest snapshot and caches the outcome
+func (collector *backupCollector) refreshRepository(ctx context.Context, repo ContextBackupRepository) {
+	ctx, cancel := collector.withTimeout(ctx, repo)
+	defer cancel()
+
+	start := time.Now()
+	state := &repositoryState{}
+	err := state.fetch(ctx, repo)
+	state.duration = time.Since(start)
+	state.collectedAt = time.Now()
+
+	if err != nil {
+		state.setError(ctx, repo, err)
+	} else {
+		options := repositoryOptions(repo)
+		if options.SizeAnomaly.Window > 0 {
+			collector.checkSize(repo.AliasName(), state, options.SizeAnomaly)
+		}
+		if options.Schedule.enabled() {
+			state.nextExpected, err = options.Schedule.nextExpected(state.creationDate)
+			if err != nil {
+				log.Printf("invalid schedule for %v: %s", repo.AliasName(), err.Error())
+			}
+		}
+	}
+
+	collector.mutex.Lock()
+	collector.states[repo.AliasName()] = state
+	collector.mutex.Unlock()
+}
+
+func (state *repositoryState) fetch(ctx context.Context, repo ContextBackupRepository) error {
+	report, err := fetchReport(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	creationDate, err := time.Parse(time.UnixDate, report.Latest.DateString)
+	if err != nil {
+		return &ParseError{err}
+	}
+
+	state.snapshot = report.Latest
+	state.creationDate = creationDate
+	state.repositorySize = report.Size
+
+	policy := repositoryOptions(repo).Retention
+	if report.Snapshots != nil {
+		if err := state.setHistory(report.Snapshots); err != nil {
+			log.Printf("snapshots of %v left out: %s", repo.AliasName(), err.Error())
+		} else if policy.enabled() {
+			state.retentionChecked = true
+			state.missingBuckets = policy.missingBuckets(state.historyDates, time.Now())
+		}
+	} else if policy.enabled() {
+		log.Printf("retention policy of %v ignored, the repository cannot list its snapshots", repo.AliasName())
+	}
+	return nil
+}
+
+// Retrieves the latest snapshot of the repository along with its snapshots and
+// its size when supported. Only the latest snapshot is required, the failures of
+// the other capabilities are logged and their metrics left out.
+func fetchReport(ctx context.Context, repo ContextBackupRepository) (*RepositoryReport, error) {
+	if reporter, ok := repo.(RepositoryReporter); ok {
+		return reporter.Report(ctx)
+	}
+
+	latest, err := repo.LatestSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &RepositoryReport{Latest: latest}
+
+	if lister, ok := repo.(SnapshotLister); ok {
+		snapshots, err := lister.Snapshots(ctx)
+		if err != nil {
+			log.Printf("failed to list the snapshots of %v: %s", repo.AliasName(), err.Error())
+		} else {
+			// An empty history is still reported as such
+			report.Snapshots = append(make([]*BackupSnapshot, 0, len(snapshots)), snapshots...)
+		}
+	}
+
+	if sizer, ok := repo.(RepositorySizer); ok {
+		size, err := sizer.RepositorySize(ctx)
+		if err != nil {
+			log.Printf("failed to retrieve the size of %v: %s", repo.AliasName(), err.Error())
+		} else {
+			report.Size = &size
+		}
+	}
+	return report, nil
+}
+
+func (state *repositoryState) setHistory(snapshots []*BackupSnapshot) error {
+	history := make([]*BackupSnapshot, 0, len(snapshots))
+	var dates []time.Time
+	var oldest time.Time
+	for _, snapshot := range snapshots {
+		creationDate, err := time.Parse(time.UnixDate, snapshot.DateString)
+		if err != nil {
+			return &ParseError{err}
+		}
+		if oldest.IsZero() || creationDate.Before(oldest) {
+			oldest = creationDate
+		}
+		history = append(history, snapshot)
+		dates = append(dates, creationDate)
+	}
+
+	state.history, state.historyDates, state.oldestDate = history, dates, oldest
+	return nil
+}
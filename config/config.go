@@ -1,10 +1,22 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/ddtmachado/prom-backup-exporter/collector"
+	"github.com/ddtmachado/prom-backup-exporter/repositories/borg"
+	"github.com/ddtmachado/prom-backup-exporter/repositories/btrfs"
 	"github.com/ddtmachado/prom-backup-exporter/repositories/elasticsearch"
 	"github.com/ddtmachado/prom-backup-exporter/repositories/file"
+	"github.com/ddtmachado/prom-backup-exporter/repositories/kopia"
+	"github.com/ddtmachado/prom-backup-exporter/repositories/pgbackrest"
 	"github.com/ddtmachado/prom-backup-exporter/repositories/restic"
+	"github.com/ddtmachado/prom-backup-exporter/repositories/s3"
+	"github.com/ddtmachado/prom-backup-exporter/repositories/velero"
+	"github.com/ddtmachado/prom-backup-exporter/repositories/zfs"
 )
 
 // Config represents the configuration struct of the service.
@@ -13,23 +25,116 @@ type Config struct {
 	Port string
 	//HTTP path to export metrics, defaults to "/metrics"
 	Path string
+	//Maximum time a refresh waits for the repositories, defaults to 2m
+	Timeout time.Duration
+	//Time between the refreshes of the repositories, defaults to 5m
+	Interval time.Duration
+	//Also exports the deprecated backup_size and backup_timestamp metrics, defaults to true
+	LegacyMetrics bool `mapstructure:"legacy_metrics"`
 
 	ResticRepos        []*restic.ResticRepository         `mapstructure:"restic"`
 	ElasticSearchRepos []*elasticsearch.ElasticSearchRepo `mapstructure:"elasticsearch"`
 	TarballRepos       []*file.TarballRepo                `mapstructure:"tarball"`
+	BorgRepos          []*borg.BorgRepository             `mapstructure:"borg"`
+	KopiaRepos         []*kopia.KopiaRepository           `mapstructure:"kopia"`
+	S3Repos            []*s3.S3Repo                       `mapstructure:"s3"`
+	PgBackRestRepos    []*pgbackrest.PgBackRestRepository `mapstructure:"pgbackrest"`
+	VeleroRepos        []*velero.VeleroRepository         `mapstructure:"velero"`
+	ZFSRepos           []*zfs.ZFSRepository               `mapstructure:"zfs"`
+	BtrfsRepos         []*btrfs.BtrfsRepository           `mapstructure:"btrfs"`
+}
+
+// CollectorOptions returns the global settings of the collector.
+func (c *Config) CollectorOptions() collector.Options {
+	return collector.Options{
+		Timeout:       c.Timeout,
+		Interval:      c.Interval,
+		LegacyMetrics: c.LegacyMetrics,
+	}
+}
+
+// Validate checks the settings of every repository and that their aliases,
+// including the ones of the group members, are unique.
+func (c *Config) Validate() error {
+	aliases := make(map[string]bool)
+	var resticGroups []string
+	for _, repo := range c.Repos() {
+		if err := collector.ValidateRepository(repo); err != nil {
+			return err
+		}
+
+		names := []string{repo.AliasName()}
+		switch group := repo.(type) {
+		case *file.TarballGroup:
+			members, err := group.Members(context.Background())
+			if err != nil {
+				return err
+			}
+			for _, member := range members {
+				names = append(names, member.AliasName())
+			}
+		case *restic.ResticGroup:
+			// The members are only known once the snapshots are listed
+			resticGroups = append(resticGroups, group.Alias)
+		}
+		for _, name := range names {
+			if aliases[name] {
+				return fmt.Errorf("duplicate alias %s", name)
+			}
+			aliases[name] = true
+		}
+	}
+
+	for alias := range aliases {
+		for _, group := range resticGroups {
+			if strings.HasPrefix(alias, group+"/") || strings.HasPrefix(alias, group+":") {
+				return fmt.Errorf("alias %s may collide with the members of the restic group %s", alias, group)
+			}
+		}
+	}
+	return nil
 }
 
 // Repos returns a concatenated list of all repositories found
 // in the config file.
-func (c *Config) Repos() []collector.BackupRepository {
-	var repos []collector.BackupRepository
+func (c *Config) Repos() []collector.ContextBackupRepository {
+	var repos []collector.ContextBackupRepository
 	for _, repo := range c.ResticRepos {
+		if repo.GroupBy != "" {
+			repos = append(repos, &restic.ResticGroup{ResticRepository: repo})
+			continue
+		}
 		repos = append(repos, repo)
 	}
 	for _, repo := range c.ElasticSearchRepos {
 		repos = append(repos, repo)
 	}
 	for _, repo := range c.TarballRepos {
+		if len(repo.Groups) > 0 {
+			repos = append(repos, &file.TarballGroup{TarballRepo: repo})
+			continue
+		}
+		repos = append(repos, repo)
+	}
+	for _, repo := range c.BorgRepos {
+		repos = append(repos, repo)
+	}
+	for _, repo := range c.KopiaRepos {
+		repos = append(repos, repo)
+	}
+	for _, repo := range c.S3Repos {
+		repos = append(repos, repo)
+	}
+	for _, repo := range c.PgBackRestRepos {
+		repos = append(repos, repo)
+	}
+	for _, repo := range c.VeleroRepos {
+		repos = append(repos, repo)
+	}
+	for _, repo := range c.ZFSRepos {
+		repos = append(repos, repo)
+	}
+	for _, repo := range c.BtrfsRepos {
 		repos = append(repos, repo)
 	}
 	return repos
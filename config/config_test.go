@@ -0,0 +1,34 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/ddtmachado/prom-backup-exporter/repositories/borg"
+	"github.com/ddtmachado/prom-backup-exporter/repositories/file"
+	"github.com/ddtmachado/prom-backup-exporter/repositories/restic"
+)
+
+func TestValidateAliases(t *testing.T) {
+	tarball := file.OpenRepository("dumps", "/backups", ".tar.gz")
+	tarball.Groups = []file.FileGroup{{Name: "db"}}
+
+	tests := map[string]struct {
+		borgAlias string
+		valid     bool
+	}{
+		"unique":              {"myBorg", true},
+		"duplicate":           {"dumps", false},
+		"group member":        {"dumps/db", false},
+		"restic group member": {"shared/host1", false},
+	}
+	for name, test := range tests {
+		c := &Config{
+			ResticRepos:  []*restic.ResticRepository{{Alias: "shared", GroupBy: restic.GroupByHost}},
+			TarballRepos: []*file.TarballRepo{tarball},
+			BorgRepos:    []*borg.BorgRepository{borg.OpenRepository(test.borgAlias, "/backups/borg", "")},
+		}
+		if err := c.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s - Expected valid %v but got %v", name, test.valid, err)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/ddtmachado/prom-backup-exporter/collector"
 	"github.com/ddtmachado/prom-backup-exporter/config"
@@ -22,8 +24,14 @@ var rootCmd = &cobra.Command{
 	Short: "backup-exporter is a backup metric exporter for prometheus",
 	Long: `Configurable backup metric exporter. Currently supported backup repositories are:
                 - Restic
+                - Borg
+                - Kopia
+                - pgBackRest
+                - Velero
+                - ZFS and Btrfs snapshots
 								- ElasticSearch
-								- Tarball directory.`,
+								- Tarball directory
+								- S3 compatible bucket.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		startExporter()
 	},
@@ -49,7 +57,8 @@ func rootHandler(c *gin.Context) {
 }
 
 func startExporter() {
-	backupCollector := collector.NewBackupCollector(globalConfig.Repos())
+	backupCollector := collector.NewBackupCollector(globalConfig.Repos(), globalConfig.CollectorOptions())
+	backupCollector.Start(context.Background())
 	prometheus.MustRegister(backupCollector)
 	router := gin.Default()
 	router.GET(globalConfig.Path, adapter.Wrap(prometheusHandlerFunc))
@@ -65,10 +74,18 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "config file (default is config.toml)")
 	rootCmd.PersistentFlags().String("port", "--port", "http port to expose the backup exporter")
 	rootCmd.PersistentFlags().String("path", "--path", "http path to expose the metrics")
+	rootCmd.PersistentFlags().Duration("timeout", 2*time.Minute, "maximum time a refresh waits for the repositories")
+	rootCmd.PersistentFlags().Duration("interval", collector.DefaultInterval, "time between the refreshes of the repositories")
 	viper.BindPFlag("Port", rootCmd.PersistentFlags().Lookup("port"))
 	viper.BindPFlag("Path", rootCmd.PersistentFlags().Lookup("path"))
+	viper.BindPFlag("Timeout", rootCmd.PersistentFlags().Lookup("timeout"))
+	viper.BindPFlag("Interval", rootCmd.PersistentFlags().Lookup("interval"))
 	viper.SetDefault("Port", "8080")
 	viper.SetDefault("Path", "/metrics")
+	viper.SetDefault("Timeout", "2m")
+	viper.SetDefault("Interval", collector.DefaultInterval.String())
+	// The deprecated metrics are kept until the dashboards are migrated
+	viper.SetDefault("legacy_metrics", true)
 }
 
 func initConfig() {
@@ -90,5 +107,9 @@ func initConfig() {
 	}
 
 	viper.Unmarshal(&globalConfig)
-	log.Printf("Config: %s", globalConfig)
+	log.Printf("Config: %+v", globalConfig)
+
+	if err := globalConfig.Validate(); err != nil {
+		log.Fatalln(err)
+	}
 }
@@ -0,0 +1,228 @@
+package borg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var execCommand = exec.CommandContext
+
+// Layouts of the archive times printed by borg, local time without zone
+// up to borg 1.2 and with the zone offset afterwards. The microseconds are
+// left out by borg when zero, Go accepts them anyway after the seconds.
+var timeLayouts = []string{"2006-01-02T15:04:05", time.RFC3339Nano}
+
+// Represents the informations about the Borg repository
+// used to retrieve informations about the archives
+type BorgRepository struct {
+	// The repository alias
+	Alias,
+	// The path or URL of the repository
+	Path,
+	// The required passphrase to open the borg repository
+	Passphrase,
+	// Optional glob restricting the archives taken into account, e.g. 'myhost-*'
+	Glob string
+
+	collector.RepositoryOptions `mapstructure:",squash"`
+}
+
+type borgArchive struct {
+	Name     string `json:"name"`
+	Start    string `json:"start"`
+	Hostname string `json:"hostname"`
+	Stats    struct {
+		OriginalSize     float64 `json:"original_size"`
+		CompressedSize   float64 `json:"compressed_size"`
+		DeduplicatedSize float64 `json:"deduplicated_size"`
+	} `json:"stats"`
+}
+
+type borgArchives struct {
+	Archives []borgArchive `json:"archives"`
+}
+
+type borgRepositoryInfo struct {
+	Cache struct {
+		Stats struct {
+			UniqueCompressedSize float64 `json:"unique_csize"`
+		} `json:"stats"`
+	} `json:"cache"`
+}
+
+// Represents the output of borg info on an archive, which holds the
+// stats of the repository along with the ones of the archive
+type borgArchiveInfo struct {
+	borgArchives
+	borgRepositoryInfo
+}
+
+func OpenRepository(alias, path, passphrase string) *BorgRepository {
+	return &BorgRepository{
+		Alias:      alias,
+		Path:       path,
+		Passphrase: passphrase,
+	}
+}
+
+func (b *BorgRepository) environmentVariables() []string {
+	return append(os.Environ(),
+		"BORG_PASSPHRASE="+b.Passphrase,
+		"BORG_REPO="+b.Path,
+	)
+}
+
+// Runs borg with the given arguments and decodes its JSON output into v.
+// The repository lock is bypassed so it can be read while a backup runs.
+func (b *BorgRepository) exec(ctx context.Context, v interface{}, args ...string) error {
+	cmd := execCommand(ctx, "borg", append(args, "--bypass-lock", "--json")...)
+	cmd.Env = b.environmentVariables()
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			log.Printf("borg process output: %s", exitErr.Stderr)
+			if bytes.Contains(exitErr.Stderr, []byte("passphrase supplied")) {
+				return collector.ErrAuthentication
+			}
+		}
+		return err
+	}
+
+	err = json.Unmarshal(out, v)
+	if err != nil {
+		return &collector.ParseError{Err: err}
+	}
+	return nil
+}
+
+func (b *BorgRepository) listArgs() []string {
+	args := []string{"list"}
+	if b.Glob != "" {
+		args = append(args, "--glob-archives", b.Glob)
+	}
+	return args
+}
+
+// Returns the archive creation date and time
+func (archive *borgArchive) creationDateString() (string, error) {
+	var err error
+	for _, layout := range timeLayouts {
+		var creationDate time.Time
+		creationDate, err = time.ParseInLocation(layout, archive.Start, time.Local)
+		if err == nil {
+			return creationDate.UTC().Format(time.UnixDate), nil
+		}
+	}
+	return "", &collector.ParseError{Err: err}
+}
+
+// Returns the alias of the Borg repository
+func (b *BorgRepository) AliasName() string {
+	return b.Alias
+}
+
+// Returns the repository type
+func (b *BorgRepository) TypeName() string {
+	return "borg"
+}
+
+// Retrieves informations about the latest archive of the Borg repository
+func (b *BorgRepository) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := b.Report(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return report.Latest, nil
+}
+
+// Retrieves the latest archive, all the archives and the size of the Borg
+// repository from a single borg list run and a borg info run on the latest archive
+func (b *BorgRepository) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+	var list borgArchives
+	err := b.exec(ctx, &list, b.listArgs()...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(list.Archives) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	// The archives are listed oldest first
+	var info borgArchiveInfo
+	err = b.exec(ctx, &info, "info", "::"+list.Archives[len(list.Archives)-1].Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(info.Archives) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	archive := info.Archives[0]
+	dateString, err := archive.creationDateString()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := backupSnapshots(list.Archives)
+	if err != nil {
+		log.Printf("archives of %v left out: %s", b.Alias, err.Error())
+	}
+
+	size := info.Cache.Stats.UniqueCompressedSize
+	return &collector.RepositoryReport{
+		Latest: &collector.BackupSnapshot{
+			Name:       archive.Name,
+			DateString: dateString,
+			Size:       archive.Stats.CompressedSize,
+			Host:       archive.Hostname,
+		},
+		Snapshots: snapshots,
+		Size:      &size,
+	}, nil
+}
+
+// Returns the listed archives without their size, which would take
+// a borg info run for each one of them
+func backupSnapshots(archives []borgArchive) ([]*collector.BackupSnapshot, error) {
+	snapshots := make([]*collector.BackupSnapshot, 0, len(archives))
+	for _, archive := range archives {
+		dateString, err := archive.creationDateString()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, &collector.BackupSnapshot{
+			Name:       archive.Name,
+			DateString: dateString,
+		})
+	}
+	return snapshots, nil
+}
+
+// Retrieves informations about all the archives of the Borg repository
+func (b *BorgRepository) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+	var list borgArchives
+	err := b.exec(ctx, &list, b.listArgs()...)
+	if err != nil {
+		return nil, err
+	}
+	return backupSnapshots(list.Archives)
+}
+
+// Retrieves the size of the deduplicated and compressed data stored in the Borg repository
+func (b *BorgRepository) RepositorySize(ctx context.Context) (float64, error) {
+	var info borgRepositoryInfo
+	err := b.exec(ctx, &info, "info")
+	if err != nil {
+		return 0, err
+	}
+	return info.Cache.Stats.UniqueCompressedSize, nil
+}
@@ -0,0 +1,230 @@
+package borg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var listJson = []byte(`{
+  "archives": [
+    {
+      "archive": "myhost-2018-09-11",
+      "id": "8d9bd3d6e5ee2d1ec4a1c9fefbb07bdec8c4a16b0c5d5a2e5f5fd6c4e8a1b2c3",
+      "name": "myhost-2018-09-11",
+      "start": "2018-09-11T09:17:07.000000",
+      "time": "2018-09-11T09:17:07.000000"
+    },
+    {
+      "archive": "myhost-2018-09-12",
+      "id": "f1c2b3a4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2",
+      "name": "myhost-2018-09-12",
+      "start": "2018-09-12T09:17:07.000000",
+      "time": "2018-09-12T09:17:07.000000"
+    }
+  ]
+}`)
+
+var infoJson = []byte(`{
+  "archives": [
+    {
+      "name": "myhost-2018-09-12",
+      "hostname": "myhost",
+      "start": "2018-09-12T09:17:07.000000",
+      "end": "2018-09-12T09:18:32.000000",
+      "stats": {
+        "compressed_size": 1371,
+        "deduplicated_size": 512,
+        "nfiles": 12,
+        "original_size": 4096
+      }
+    }
+  ],
+  "cache": {
+    "stats": {
+      "total_chunks": 42,
+      "unique_csize": 8192
+    }
+  }
+}`)
+
+var repositoryInfoJson = []byte(`{
+  "cache": {
+    "stats": {
+      "total_chunks": 42,
+      "unique_csize": 8192
+    }
+  }
+}`)
+
+// The number of borg runs started by the test
+var execCount int
+
+func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	execCount++
+	cs := []string{"-test.run=TestHelperProcess", "--", command}
+	cs = append(cs, args...)
+	return exec.CommandContext(ctx, os.Args[0], cs...)
+}
+
+// Returns the borg arguments when running as a fake borg process, nil otherwise
+func helperArgs() []string {
+	for idx, arg := range os.Args {
+		if arg == "--" && idx+1 < len(os.Args) && os.Args[idx+1] == "borg" {
+			return os.Args[idx+2:]
+		}
+	}
+	return nil
+}
+
+func TestHelperProcess(t *testing.T) {
+	args := helperArgs()
+	if args == nil {
+		return
+	}
+
+	if os.Getenv("BORG_PASSPHRASE") == "wrong" {
+		fmt.Fprintf(os.Stderr, "passphrase supplied in BORG_PASSPHRASE, by BORG_PASSCOMMAND or via BORG_PASSPHRASE_FD is incorrect.")
+		os.Exit(52)
+	}
+
+	cmdArgs := strings.Join(args, " ")
+	if !strings.HasSuffix(cmdArgs, " --bypass-lock --json") {
+		fmt.Fprintf(os.Stderr, "expected the lock to be bypassed %s", cmdArgs)
+		os.Exit(2)
+	}
+
+	switch {
+	case strings.HasPrefix(cmdArgs, "list"):
+		fmt.Fprintf(os.Stdout, "%s", listJson)
+	case strings.HasPrefix(cmdArgs, "info ::myhost-2018-09-12"):
+		fmt.Fprintf(os.Stdout, "%s", infoJson)
+	case strings.HasPrefix(cmdArgs, "info"):
+		fmt.Fprintf(os.Stdout, "%s", repositoryInfoJson)
+	default:
+		fmt.Fprintf(os.Stderr, "unexpected arguments %s", cmdArgs)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func setupTest(passphrase string) (*BorgRepository, func()) {
+	execCommand = fakeExecCommand
+	repo := OpenRepository("testRepo", "/backups/borg", passphrase)
+	return repo, func() {
+		execCommand = exec.CommandContext
+	}
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	repo, teardown := setupTest("myPassphrase")
+	defer teardown()
+
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if snapshot.Name != "myhost-2018-09-12" {
+		t.Errorf("Name - Expected %s but got %s", "myhost-2018-09-12", snapshot.Name)
+	}
+
+	if snapshot.Size != 1371 {
+		t.Errorf("Size - Expected %f but got %f", float64(1371), snapshot.Size)
+	}
+
+	expected := time.Date(2018, 9, 12, 9, 17, 7, 0, time.Local).UTC().Format(time.UnixDate)
+	if snapshot.DateString != expected {
+		t.Errorf("Date - Expected %s but got %s", expected, snapshot.DateString)
+	}
+
+	if snapshot.Host != "myhost" {
+		t.Errorf("Host - Expected %s but got %s", "myhost", snapshot.Host)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	repo, teardown := setupTest("myPassphrase")
+	defer teardown()
+
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected 2 snapshots but got %d", len(snapshots))
+	}
+
+	size, err := repo.RepositorySize(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if size != 8192 {
+		t.Errorf("Size - Expected %f but got %f", float64(8192), size)
+	}
+}
+
+func TestReport(t *testing.T) {
+	repo, teardown := setupTest("myPassphrase")
+	defer teardown()
+
+	execCount = 0
+	report, err := repo.Report(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if execCount != 2 {
+		t.Errorf("Expected a borg list and a borg info run but got %d runs", execCount)
+	}
+	if report.Latest.Name != "myhost-2018-09-12" || report.Latest.Size != 1371 {
+		t.Errorf("Expected the latest archive with its size but got %v", report.Latest)
+	}
+	if len(report.Snapshots) != 2 {
+		t.Errorf("Expected 2 snapshots but got %d", len(report.Snapshots))
+	}
+	if report.Size == nil || *report.Size != 8192 {
+		t.Errorf("Size - Expected %f but got %v", float64(8192), report.Size)
+	}
+}
+
+func TestLatestSnapshotWrongPassphrase(t *testing.T) {
+	repo, teardown := setupTest("wrong")
+	defer teardown()
+
+	_, err := repo.LatestSnapshot(context.Background())
+	if err != collector.ErrAuthentication {
+		t.Errorf("Expected %v but got %v", collector.ErrAuthentication, err)
+	}
+}
+
+func TestCreationDateString(t *testing.T) {
+	expected := time.Date(2018, 9, 12, 9, 17, 7, 0, time.Local).UTC().Format(time.UnixDate)
+	for _, start := range []string{"2018-09-12T09:17:07", "2018-09-12T09:17:07.286761"} {
+		archive := &borgArchive{Start: start}
+		date, err := archive.creationDateString()
+		if err != nil {
+			t.Errorf("%s - Unexpected error - '%s'", start, err.Error())
+			continue
+		}
+		if date != expected {
+			t.Errorf("%s - Expected %s but got %s", start, expected, date)
+		}
+	}
+
+	archive := &borgArchive{Start: "2018-09-12T09:17:07.286761+00:00"}
+	date, err := archive.creationDateString()
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if date != "Wed Sep 12 09:17:07 UTC 2018" {
+		t.Errorf("Expected %s but got %s", "Wed Sep 12 09:17:07 UTC 2018", date)
+	}
+}
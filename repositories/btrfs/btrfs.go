@@ -0,0 +1,252 @@
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var execCommand = exec.CommandContext
+
+// Layout of the snapshot creation times printed by btrfs, local time without zone
+const otimeLayout = "2006-01-02 15:04:05"
+
+// Represents the informations about the Btrfs filesystem
+// used to retrieve informations about its snapshots
+type BtrfsRepository struct {
+	// The repository alias
+	Alias,
+	// A path of the filesystem holding the snapshots, e.g. /mnt/pool
+	Path,
+	// Optional regular expression the snapshot paths must match, e.g. '^snapshots/home-'
+	Pattern string
+	// Reads the snapshot sizes from the quota groups, quotas must be enabled on the filesystem
+	Qgroups bool
+
+	collector.RepositoryOptions `mapstructure:",squash"`
+}
+
+type btrfsSnapshot struct {
+	Id string
+	// The snapshot path, relative to the top level of the filesystem
+	Path     string
+	Creation time.Time
+	// The exclusive and referenced sizes of the quota group of the snapshot
+	Used       float64
+	Referenced float64
+}
+
+func OpenRepository(alias, path string) *BtrfsRepository {
+	return &BtrfsRepository{
+		Alias: alias,
+		Path:  path,
+	}
+}
+
+// Runs btrfs with the given arguments and returns its output
+func (b *BtrfsRepository) exec(ctx context.Context, args ...string) (string, error) {
+	out, err := execCommand(ctx, "btrfs", args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			log.Printf("btrfs process output: %s", exitErr.Stderr)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Lists the snapshots of the filesystem matching the pattern
+func (b *BtrfsRepository) listSnapshots(ctx context.Context) ([]btrfsSnapshot, error) {
+	var pattern *regexp.Regexp
+	if b.Pattern != "" {
+		var err error
+		pattern, err = regexp.Compile(b.Pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := b.exec(ctx, "subvolume", "list", "-s", b.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []btrfsSnapshot
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		snapshot, err := parseSnapshot(line)
+		if err != nil {
+			return nil, &collector.ParseError{Err: err}
+		}
+		if pattern == nil || pattern.MatchString(snapshot.Path) {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	if b.Qgroups && len(snapshots) > 0 {
+		sizes, err := b.qgroupSizes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for idx := range snapshots {
+			size := sizes[snapshots[idx].Id]
+			snapshots[idx].Used, snapshots[idx].Referenced = size[0], size[1]
+		}
+	}
+	return snapshots, nil
+}
+
+// Parses a line of btrfs subvolume list -s, e.g.
+// ID 259 gen 12 cgen 12 top level 5 otime 2018-09-12 09:17:07 path snapshots/home
+func parseSnapshot(line string) (btrfsSnapshot, error) {
+	pathIdx := strings.Index(line, " path ")
+	if pathIdx < 0 {
+		return btrfsSnapshot{}, errors.New("unexpected btrfs subvolume line: " + line)
+	}
+	fields := strings.Fields(line[:pathIdx])
+	if len(fields) < 2 || fields[0] != "ID" {
+		return btrfsSnapshot{}, errors.New("unexpected btrfs subvolume line: " + line)
+	}
+
+	snapshot := btrfsSnapshot{Id: fields[1], Path: line[pathIdx+len(" path "):]}
+	for idx, field := range fields {
+		if field == "otime" && idx+2 < len(fields) {
+			creation, err := time.ParseInLocation(otimeLayout, fields[idx+1]+" "+fields[idx+2], time.Local)
+			if err != nil {
+				return btrfsSnapshot{}, err
+			}
+			snapshot.Creation = creation
+			return snapshot, nil
+		}
+	}
+	return btrfsSnapshot{}, errors.New("no creation time in btrfs subvolume line: " + line)
+}
+
+// Returns the exclusive and referenced sizes of the quota groups of the subvolumes by id
+func (b *BtrfsRepository) qgroupSizes(ctx context.Context) (map[string][2]float64, error) {
+	out, err := b.exec(ctx, "qgroup", "show", "--raw", b.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string][2]float64)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		// The subvolume groups are the level 0 ones, the header lines are skipped
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "0/") {
+			continue
+		}
+		referenced, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, &collector.ParseError{Err: err}
+		}
+		used, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, &collector.ParseError{Err: err}
+		}
+		sizes[strings.TrimPrefix(fields[0], "0/")] = [2]float64{used, referenced}
+	}
+	return sizes, nil
+}
+
+func (snapshot *btrfsSnapshot) backupSnapshot() *collector.BackupSnapshot {
+	return &collector.BackupSnapshot{
+		Name:       snapshot.Path,
+		DateString: snapshot.Creation.UTC().Format(time.UnixDate),
+		Size:       snapshot.Referenced,
+	}
+}
+
+// Returns an error when the path is missing or the pattern does not compile
+func (b *BtrfsRepository) Validate() error {
+	if b.Path == "" {
+		return errors.New("the btrfs path is required")
+	}
+	if b.Pattern != "" {
+		if _, err := regexp.Compile(b.Pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the alias of the Btrfs repository
+func (b *BtrfsRepository) AliasName() string {
+	return b.Alias
+}
+
+// Returns the repository type
+func (b *BtrfsRepository) TypeName() string {
+	return "btrfs"
+}
+
+// Retrieves informations about the latest snapshot of the filesystem
+func (b *BtrfsRepository) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := b.Report(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return report.Latest, nil
+}
+
+// Retrieves the latest snapshot and all the snapshots of the filesystem from a single listing
+func (b *BtrfsRepository) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+	snapshots, err := b.listSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snapshots) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	latest := snapshots[0]
+	for _, snapshot := range snapshots[1:] {
+		if !snapshot.Creation.Before(latest.Creation) {
+			latest = snapshot
+		}
+	}
+
+	backupSnapshot := latest.backupSnapshot()
+	if b.Qgroups {
+		backupSnapshot.Metrics = []collector.Metric{
+			{
+				Name:  "backup_last_snapshot_used_bytes",
+				Help:  "The space only held by the latest snapshot, ZFS and Btrfs only",
+				Value: latest.Used,
+			},
+			{
+				Name:  "backup_last_snapshot_referenced_bytes",
+				Help:  "The data referenced by the latest snapshot, ZFS and Btrfs only",
+				Value: latest.Referenced,
+			},
+		}
+	}
+	return &collector.RepositoryReport{Latest: backupSnapshot, Snapshots: backupSnapshots(snapshots)}, nil
+}
+
+// Retrieves informations about all the snapshots of the filesystem
+func (b *BtrfsRepository) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+	btrfsSnapshots, err := b.listSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return backupSnapshots(btrfsSnapshots), nil
+}
+
+func backupSnapshots(btrfsSnapshots []btrfsSnapshot) []*collector.BackupSnapshot {
+	var snapshots []*collector.BackupSnapshot
+	for _, snapshot := range btrfsSnapshots {
+		snapshots = append(snapshots, snapshot.backupSnapshot())
+	}
+	return snapshots
+}
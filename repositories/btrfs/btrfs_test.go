@@ -0,0 +1,179 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var subvolumesOutput = `ID 259 gen 12 cgen 12 top level 5 otime 2018-09-11 09:17:07 path snapshots/home-2018-09-11
+ID 260 gen 15 cgen 15 top level 5 otime 2018-09-12 09:17:07 path snapshots/home-2018-09-12
+ID 261 gen 16 cgen 16 top level 5 otime 2018-09-12 10:00:00 path snapshots/var log-2018-09-12
+`
+
+var qgroupsOutput = `qgroupid         rfer         excl
+--------         ----         ----
+0/5             16384        16384
+0/259         1048576        32768
+0/260         2097152        65536
+1/100         3145728        98304
+`
+
+// The number of btrfs runs started by the test
+var execCount int
+
+func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	execCount++
+	cs := []string{"-test.run=TestHelperProcess", "--", command}
+	cs = append(cs, args...)
+	return exec.CommandContext(ctx, os.Args[0], cs...)
+}
+
+// Returns the btrfs arguments when running as a fake btrfs process, nil otherwise
+func helperArgs() []string {
+	for idx, arg := range os.Args {
+		if arg == "--" && idx+1 < len(os.Args) && os.Args[idx+1] == "btrfs" {
+			return os.Args[idx+2:]
+		}
+	}
+	return nil
+}
+
+func TestHelperProcess(t *testing.T) {
+	args := helperArgs()
+	if args == nil {
+		return
+	}
+
+	cmdArgs := strings.Join(args, " ")
+	switch cmdArgs {
+	case "subvolume list -s /mnt/pool":
+		fmt.Fprintf(os.Stdout, "%s", subvolumesOutput)
+	case "qgroup show --raw /mnt/pool":
+		fmt.Fprintf(os.Stdout, "%s", qgroupsOutput)
+	case "subvolume list -s /mnt/empty":
+	default:
+		fmt.Fprintf(os.Stderr, "unexpected arguments %s", cmdArgs)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func setupTest(path string) (*BtrfsRepository, func()) {
+	execCommand = fakeExecCommand
+	repo := OpenRepository("testRepo", path)
+	return repo, func() {
+		execCommand = exec.CommandContext
+	}
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	repo, teardown := setupTest("/mnt/pool")
+	defer teardown()
+	repo.Pattern = "^snapshots/home-"
+	repo.Qgroups = true
+
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if snapshot.Name != "snapshots/home-2018-09-12" {
+		t.Errorf("Name - Expected %s but got %s", "snapshots/home-2018-09-12", snapshot.Name)
+	}
+
+	if snapshot.Size != 2097152 {
+		t.Errorf("Size - Expected %f but got %f", float64(2097152), snapshot.Size)
+	}
+
+	expected := time.Date(2018, 9, 12, 9, 17, 7, 0, time.Local).UTC().Format(time.UnixDate)
+	if snapshot.DateString != expected {
+		t.Errorf("Date - Expected %s but got %s", expected, snapshot.DateString)
+	}
+
+	if len(snapshot.Metrics) != 2 || snapshot.Metrics[0].Value != 65536 || snapshot.Metrics[1].Value != 2097152 {
+		t.Errorf("Metrics - Expected the used and referenced sizes but got %v", snapshot.Metrics)
+	}
+}
+
+func TestSnapshotsWithoutQgroups(t *testing.T) {
+	repo, teardown := setupTest("/mnt/pool")
+	defer teardown()
+
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if len(snapshots) != 3 {
+		t.Fatalf("Expected 3 snapshots but got %d", len(snapshots))
+	}
+
+	if snapshots[2].Name != "snapshots/var log-2018-09-12" {
+		t.Errorf("Name - Expected the path with its space but got %s", snapshots[2].Name)
+	}
+
+	latest, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if latest.Size != 0 || len(latest.Metrics) != 0 {
+		t.Errorf("Expected no size without quota groups but got %f and %v", latest.Size, latest.Metrics)
+	}
+}
+
+func TestLatestSnapshotNotFound(t *testing.T) {
+	repo, teardown := setupTest("/mnt/empty")
+	defer teardown()
+
+	_, err := repo.LatestSnapshot(context.Background())
+	if err != collector.ErrSnapshotNotFound {
+		t.Errorf("Expected %v but got %v", collector.ErrSnapshotNotFound, err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	repo, teardown := setupTest("/mnt/pool")
+	defer teardown()
+	repo.Pattern = "^snapshots/home-"
+	repo.Qgroups = true
+
+	execCount = 0
+	report, err := repo.Report(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if execCount != 2 {
+		t.Errorf("Expected a btrfs subvolume list and a btrfs qgroup show run but got %d runs", execCount)
+	}
+	if report.Latest == nil || len(report.Latest.Metrics) != 2 {
+		t.Errorf("Expected the latest snapshot with its sizes but got %v", report.Latest)
+	}
+	if len(report.Snapshots) != 2 {
+		t.Errorf("Expected 2 snapshots but got %d", len(report.Snapshots))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := OpenRepository("testRepo", "").Validate(); err == nil {
+		t.Errorf("Expected an error for a missing path")
+	}
+
+	repo := OpenRepository("testRepo", "/mnt/pool")
+	repo.Pattern = "("
+	if err := repo.Validate(); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+
+	repo.Pattern = "^snapshots/home-"
+	if err := repo.Validate(); err != nil {
+		t.Errorf("Unexpected error - '%s'", err.Error())
+	}
+}
@@ -0,0 +1,74 @@
+package elasticsearch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Builds the HTTP client of the repository, it is then shared by all its requests.
+// It is built again by the next request when it failed, e.g. on a missing file.
+func (er *ElasticSearchRepo) httpClient() (*http.Client, error) {
+	er.clientMutex.Lock()
+	defer er.clientMutex.Unlock()
+	if er.client != nil {
+		return er.client, nil
+	}
+
+	var err error
+	er.client, err = er.newClient()
+	return er.client, err
+}
+
+func (er *ElasticSearchRepo) newClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: er.InsecureSkipVerify}
+
+	if er.CACert != "" {
+		pem, err := ioutil.ReadFile(er.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + er.CACert)
+		}
+	}
+
+	if er.ClientCert != "" || er.ClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(er.ClientCert, er.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}, nil
+}
+
+// Sets the credentials of the repository on the request, the API key
+// is preferred to the bearer token and the bearer token to basic auth
+func (er *ElasticSearchRepo) authenticate(req *http.Request) {
+	switch {
+	case er.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+er.APIKey)
+	case er.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+er.BearerToken)
+	case er.Username != "":
+		req.SetBasicAuth(er.Username, er.Password)
+	}
+}
@@ -0,0 +1,160 @@
+package elasticsearch
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Serves the snapshots over TLS, only answering the requests holding the given authorization
+func setupTLSTest(t *testing.T, authorization string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(jsonAll)
+	}))
+}
+
+// Writes the PEM encoded blocks to a file of the directory
+func writePEM(t *testing.T, dir, name, kind string, der []byte) string {
+	file := filepath.Join(dir, name)
+	content := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "elasticsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestTLSCredentials(t *testing.T) {
+	t.Log("Testing the credentials sent to a cluster with a private authority")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name          string
+		configure     func(repo *ElasticSearchRepo)
+		authorization string
+	}{
+		{"basic auth", func(repo *ElasticSearchRepo) { repo.Username, repo.Password = "elastic", "changeme" }, "Basic ZWxhc3RpYzpjaGFuZ2VtZQ=="},
+		{"API key", func(repo *ElasticSearchRepo) { repo.APIKey = "aWQ6a2V5" }, "ApiKey aWQ6a2V5"},
+		{"bearer token", func(repo *ElasticSearchRepo) { repo.BearerToken = "token" }, "Bearer token"},
+	}
+	for _, test := range tests {
+		ts := setupTLSTest(t, test.authorization)
+		repo := OpenRepository("testRepo", ts.URL, "my_backup")
+		repo.CACert = writePEM(t, dir, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+		test.configure(repo)
+
+		if _, err := repo.Snapshots(context.Background()); err != nil {
+			t.Errorf("Unexpected error with %s: %s", test.name, err.Error())
+		}
+		ts.Close()
+	}
+}
+
+func TestTLSVerification(t *testing.T) {
+	t.Log("Testing the verification of the cluster certificate")
+	ts := setupTLSTest(t, "")
+	defer ts.Close()
+
+	repo := OpenRepository("testRepo", ts.URL, "my_backup")
+	if _, err := repo.Snapshots(context.Background()); err == nil {
+		t.Errorf("Expected an error for a certificate signed by an unknown authority")
+	}
+
+	repo = OpenRepository("testRepo", ts.URL, "my_backup")
+	repo.InsecureSkipVerify = true
+	if _, err := repo.Snapshots(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repo = OpenRepository("testRepo", ts.URL, "my_backup")
+	repo.CACert = filepath.Join(dir, "ca.pem")
+	if _, err := repo.Snapshots(context.Background()); err == nil {
+		t.Errorf("Expected an error for a missing CA bundle")
+	}
+
+	// The client is built again once the CA bundle appears
+	writePEM(t, dir, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+	if _, err := repo.Snapshots(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	t.Log("Testing a cluster requiring client certificates")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "backup-exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jsonAll)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	ts.TLS.ClientCAs.AddCert(certificate)
+	ts.StartTLS()
+	defer ts.Close()
+
+	repo := OpenRepository("testRepo", ts.URL, "my_backup")
+	repo.InsecureSkipVerify = true
+	if _, err := repo.Snapshots(context.Background()); err == nil {
+		t.Errorf("Expected an error without a client certificate")
+	}
+
+	repo = OpenRepository("testRepo", ts.URL, "my_backup")
+	repo.InsecureSkipVerify = true
+	repo.ClientCert = writePEM(t, dir, "client.pem", "CERTIFICATE", der)
+	repo.ClientKey = writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDer)
+	if _, err := repo.Snapshots(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+}
@@ -1,19 +1,35 @@
 package elasticsearch
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ddtmachado/prom-backup-exporter/collector"
 )
 
-const snapshotName = "backup-es-latest"
+// States of the snapshots, exported by the backup_last_snapshot_state metric
+var snapshotStates = []string{"SUCCESS", "PARTIAL", "FAILED", "INCOMPATIBLE"}
+
+// State of the snapshots still running, never reported as the latest one
+const stateInProgress = "IN_PROGRESS"
+
+// States of the snapshots that can be restored, the latest snapshot is the
+// newest one of them so failed snapshots do not count as fresh backups
+var restorableStates = []string{"SUCCESS", "PARTIAL"}
+
+// Maximum number of snapshot sizes requested by a refresh for the history, as the
+// status of a snapshot is read from the repository. The sizes are kept once known.
+const maxSizeRequests = 20
 
 type elasticSearchSnapshot struct {
 	Name       string `json:"snapshot"`
@@ -28,6 +44,23 @@ type elasticSearchQuery struct {
 	Snapshots []elasticSearchSnapshot `json:"snapshots"`
 }
 
+// Represents a snapshot as listed by the _snapshot/<repo>/_all endpoint
+type elasticSearchSnapshotInfo struct {
+	Name            string `json:"snapshot"`
+	State           string `json:"state"`
+	TimeInMillis    int64  `json:"start_time_in_millis"`
+	EndTimeInMillis int64  `json:"end_time_in_millis"`
+	DurationMillis  int64  `json:"duration_in_millis"`
+	Shards          struct {
+		Total  float64 `json:"total"`
+		Failed float64 `json:"failed"`
+	} `json:"shards"`
+}
+
+type elasticSearchListQuery struct {
+	Snapshots []elasticSearchSnapshotInfo `json:"snapshots"`
+}
+
 // Represents the informations about the ElasticSearch repository
 // used to retrieve informations about the snapshots
 type ElasticSearchRepo struct {
@@ -36,7 +69,36 @@ type ElasticSearchRepo struct {
 	// The Elasticsearch URL
 	URL,
 	// The repository name
-	Repo string
+	Repo,
+	// Optional regular expression the snapshot names must match
+	Pattern,
+	// The kind of cluster, "elasticsearch" (default) or "opensearch"
+	Flavor string
+	// Also reports the snapshot policies of the cluster targeting the repository
+	Policies bool
+
+	// Optional - basic auth credentials
+	Username, Password string
+	// Optional - API key, as the base64 encoded id:key returned by Elasticsearch
+	APIKey string `mapstructure:"api_key"`
+	// Optional - bearer token, e.g. a service account token
+	BearerToken string `mapstructure:"bearer_token"`
+	// Optional - PEM bundle of the authorities trusted to sign the cluster certificate
+	CACert string `mapstructure:"ca_cert"`
+	// Optional - PEM client certificate and key files
+	ClientCert string `mapstructure:"client_cert"`
+	ClientKey  string `mapstructure:"client_key"`
+	// Do not verify the cluster certificate, meant for tests only
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+
+	clientMutex sync.Mutex
+	client      *http.Client
+
+	// The sizes of the snapshots by name, a snapshot never changes once finished
+	sizesMutex sync.Mutex
+	sizes      map[string]float64
+
+	collector.RepositoryOptions `mapstructure:",squash"`
 }
 
 func OpenRepository(alias, url, repo string) *ElasticSearchRepo {
@@ -52,51 +114,290 @@ func (er *ElasticSearchRepo) AliasName() string {
 	return er.Alias
 }
 
+// Returns the repository type
+func (er *ElasticSearchRepo) TypeName() string {
+	return "elasticsearch"
+}
+
 // Returns the snapshot creation date and time
-func (snapshot *elasticSearchSnapshot) DateString() string {
-	convertedTime := time.Unix(0, snapshot.Stats.TimeInMillis*int64(time.Millisecond))
+func (snapshot *elasticSearchSnapshotInfo) DateString() string {
+	convertedTime := time.Unix(0, snapshot.TimeInMillis*int64(time.Millisecond))
 	return convertedTime.UTC().Format(time.UnixDate)
 }
 
-// Retrieves informations about the latest snapshot of the ElasticSearch repository
-func (er *ElasticSearchRepo) LatestSnapshot() (*collector.BackupSnapshot, error) {
+// Sends a GET request to the Elasticsearch API and decodes the JSON answer into v
+func (er *ElasticSearchRepo) get(ctx context.Context, v interface{}, elem ...string) error {
+	u, err := url.Parse(er.URL)
+	if err != nil {
+		return err
+	}
 
-	log.Println("Retrieving information about the snapshot - ", snapshotName)
+	client, err := er.httpClient()
+	if err != nil {
+		return err
+	}
 
-	u, err := url.Parse(er.URL)
+	u.Path = path.Join(append([]string{u.Path}, elem...)...)
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	er.authenticate(req)
 
-	u.Path = path.Join(u.Path, "_snapshot", er.Repo, snapshotName, "_status")
-	resp, err := http.Get(u.String())
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return collector.ErrAuthentication
+	case http.StatusNotFound:
+		return collector.ErrSnapshotNotFound
+	default:
+		return fmt.Errorf("http error %d", resp.StatusCode)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// Returns the snapshots of the repository matching the pattern
+func (er *ElasticSearchRepo) listSnapshots(ctx context.Context) ([]elasticSearchSnapshotInfo, error) {
+	var pattern *regexp.Regexp
+	if er.Pattern != "" {
+		var err error
+		pattern, err = regexp.Compile(er.Pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := &elasticSearchListQuery{}
+	err := er.get(ctx, query, "_snapshot", er.Repo, "_all")
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("http error " + string(resp.StatusCode))
+	var snapshots []elasticSearchSnapshotInfo
+	for _, snapshot := range query.Snapshots {
+		if pattern == nil || pattern.MatchString(snapshot.Name) {
+			snapshots = append(snapshots, snapshot)
+		}
 	}
+	return snapshots, nil
+}
 
+// Returns the time the snapshot ended, or started when still running
+func (snapshot *elasticSearchSnapshotInfo) completion() int64 {
+	if snapshot.EndTimeInMillis > 0 {
+		return snapshot.EndTimeInMillis
+	}
+	return snapshot.TimeInMillis
+}
+
+// Returns the repository specific metrics of the latest snapshot and the
+// state of the newest finished one, which may have failed
+func (snapshot *elasticSearchSnapshotInfo) metrics(newest *elasticSearchSnapshotInfo) []collector.Metric {
+	metrics := []collector.Metric{
+		{
+			Name:  "backup_last_snapshot_shard_failures",
+			Help:  "The number of shards the latest snapshot failed to save, Elasticsearch only",
+			Value: snapshot.Shards.Failed,
+		},
+		{
+			Name:  "backup_last_snapshot_duration_seconds",
+			Help:  "The time taken by the latest snapshot, Elasticsearch only",
+			Value: float64(snapshot.DurationMillis) / 1000,
+		},
+	}
+	metrics = append(metrics, stateMetrics("backup_last_snapshot_state",
+		"1 for the state of the latest snapshot, 0 for the others, Elasticsearch only", snapshot.State)...)
+	return append(metrics, stateMetrics("backup_newest_snapshot_state",
+		"1 for the state of the newest finished snapshot, whatever it is, 0 for the others, Elasticsearch only", newest.State)...)
+}
+
+// Returns a metric for each snapshot state, 1 for the given state and 0 for the others
+func stateMetrics(name, help, current string) []collector.Metric {
+	var metrics []collector.Metric
+	for _, state := range snapshotStates {
+		var value float64
+		if current == state {
+			value = 1
+		}
+		metrics = append(metrics, collector.Metric{
+			Name:   name,
+			Help:   help,
+			Labels: map[string]string{"state": state},
+			Value:  value,
+		})
+	}
+	return metrics
+}
+
+// Returns whether the snapshot can be restored
+func (snapshot *elasticSearchSnapshotInfo) restorable() bool {
+	for _, state := range restorableStates {
+		if snapshot.State == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Retrieves the sizes of the given snapshots with a single status request and
+// keeps them for the following refreshes
+func (er *ElasticSearchRepo) fetchSizes(ctx context.Context, names []string) error {
+	// The size is only reported by the status of the snapshot
 	query := &elasticSearchQuery{}
-	err = json.Unmarshal(body, &query)
+	err := er.get(ctx, query, "_snapshot", er.Repo, strings.Join(names, ","), "_status")
+	if err != nil {
+		return err
+	}
+
+	er.sizesMutex.Lock()
+	defer er.sizesMutex.Unlock()
+	if er.sizes == nil {
+		er.sizes = make(map[string]float64)
+	}
+	for _, snapshot := range query.Snapshots {
+		er.sizes[snapshot.Name] = snapshot.Stats.Size
+	}
+	return nil
+}
+
+// Returns the size of the snapshot, false when it is not known yet
+func (er *ElasticSearchRepo) size(name string) (float64, bool) {
+	er.sizesMutex.Lock()
+	defer er.sizesMutex.Unlock()
+	size, ok := er.sizes[name]
+	return size, ok
+}
+
+// Forgets the sizes of the snapshots that are no longer listed
+func (er *ElasticSearchRepo) pruneSizes(snapshots []elasticSearchSnapshotInfo) {
+	listed := make(map[string]bool, len(snapshots))
+	for _, snapshot := range snapshots {
+		listed[snapshot.Name] = true
+	}
+
+	er.sizesMutex.Lock()
+	defer er.sizesMutex.Unlock()
+	for name := range er.sizes {
+		if !listed[name] {
+			delete(er.sizes, name)
+		}
+	}
+}
+
+// Returns the restorable snapshots with the sizes known so far, the missing ones are
+// left to 0. Failed and running snapshots do not count in the history.
+func (er *ElasticSearchRepo) backupSnapshots(snapshots []elasticSearchSnapshotInfo) []*collector.BackupSnapshot {
+	backupSnapshots := make([]*collector.BackupSnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if !snapshot.restorable() {
+			continue
+		}
+		size, _ := er.size(snapshot.Name)
+		backupSnapshots = append(backupSnapshots, &collector.BackupSnapshot{
+			Name:       snapshot.Name,
+			DateString: snapshot.DateString(),
+			Size:       size,
+		})
+	}
+	return backupSnapshots
+}
+
+// Retrieves informations about the latest successful or partial snapshot of the ElasticSearch repository
+func (er *ElasticSearchRepo) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := er.Report(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return report.Latest, nil
+}
+
+// Retrieves the latest successful or partial snapshot and all the snapshots from a single listing.
+// The sizes of the older snapshots are requested a few at a time and kept once known.
+func (er *ElasticSearchRepo) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+
+	log.Println("Retrieving information about the latest snapshot of the repository - ", er.Repo)
 
-	if len(query.Snapshots) == 0 {
+	snapshots, err := er.listSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest, newest *elasticSearchSnapshotInfo
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		if snapshot.State == stateInProgress {
+			continue
+		}
+		if newest == nil || snapshot.completion() > newest.completion() {
+			newest = snapshot
+		}
+		if snapshot.restorable() && (latest == nil || snapshot.completion() > latest.completion()) {
+			latest = snapshot
+		}
+	}
+	if latest == nil {
 		return nil, collector.ErrSnapshotNotFound
 	}
 
-	return &collector.BackupSnapshot{
-		Name:       query.Snapshots[0].Name,
-		DateString: query.Snapshots[0].DateString(),
-		Size:       query.Snapshots[0].Stats.Size,
+	size, ok := er.size(latest.Name)
+	if !ok {
+		if err := er.fetchSizes(ctx, []string{latest.Name}); err != nil {
+			return nil, err
+		}
+		size, _ = er.size(latest.Name)
+	}
+
+	er.pruneSizes(snapshots)
+	var missing []string
+	for _, snapshot := range snapshots {
+		if _, ok := er.size(snapshot.Name); !ok && snapshot.restorable() && len(missing) < maxSizeRequests {
+			missing = append(missing, snapshot.Name)
+		}
+	}
+	if len(missing) > 0 {
+		if err := er.fetchSizes(ctx, missing); err != nil {
+			log.Printf("failed to retrieve the snapshot sizes of %v: %s", er.Alias, err.Error())
+		}
+	}
+
+	// The snapshots are still reported when the policies cannot be read
+	policyMetrics, err := er.policyMetrics(ctx)
+	if err != nil {
+		log.Printf("failed to retrieve the snapshot policies of %v: %s", er.Alias, err.Error())
+	}
+
+	return &collector.RepositoryReport{
+		Latest: &collector.BackupSnapshot{
+			Name:       latest.Name,
+			DateString: latest.DateString(),
+			Size:       size,
+			Metrics:    append(latest.metrics(newest), policyMetrics...),
+		},
+		Snapshots: er.backupSnapshots(snapshots),
 	}, nil
 }
+
+// Retrieves informations about the successful and partial snapshots of the
+// ElasticSearch repository, with the sizes known from the previous refreshes
+func (er *ElasticSearchRepo) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+
+	log.Println("Retrieving information about the snapshots of the repository - ", er.Repo)
+
+	snapshots, err := er.listSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return er.backupSnapshots(snapshots), nil
+}
@@ -1,15 +1,21 @@
 package elasticsearch
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
 )
 
 var jsonOk = []byte(`{  
 	"snapshots":[  
 	   {  
-		  "snapshot":"backup-es-latest",
+		  "snapshot":"nightly-2018.09.06",
 		  "repository":"my_backup",         
 		  "stats":{             
 			 "start_time_in_millis":1536243158017,             
@@ -19,6 +25,68 @@ var jsonOk = []byte(`{
 	]
  }`)
 
+var jsonAll = []byte(`{
+	"snapshots": [
+		{
+			"snapshot": "nightly-2018.09.05",
+			"repository": "my_backup",
+			"state": "SUCCESS",
+			"start_time_in_millis": 1536156758017,
+			"end_time_in_millis": 1536156818017,
+			"duration_in_millis": 60000,
+			"shards": { "total": 5, "failed": 0, "successful": 5 }
+		},
+		{
+			"snapshot": "nightly-2018.09.06",
+			"repository": "my_backup",
+			"state": "PARTIAL",
+			"start_time_in_millis": 1536243158017,
+			"end_time_in_millis": 1536243278017,
+			"duration_in_millis": 120000,
+			"shards": { "total": 5, "failed": 2, "successful": 3 }
+		},
+		{
+			"snapshot": "manual-2018.09.06",
+			"repository": "my_backup",
+			"state": "SUCCESS",
+			"start_time_in_millis": 1536156000000,
+			"end_time_in_millis": 1536156060000,
+			"duration_in_millis": 60000,
+			"shards": { "total": 5, "failed": 0, "successful": 5 }
+		},
+		{
+			"snapshot": "nightly-2018.09.07",
+			"repository": "my_backup",
+			"state": "IN_PROGRESS",
+			"start_time_in_millis": 1536329558017,
+			"end_time_in_millis": 0,
+			"duration_in_millis": 0,
+			"shards": { "total": 0, "failed": 0, "successful": 0 }
+		}
+	]
+}`)
+
+var jsonFailed = []byte(`{
+	"snapshots": [
+		{
+			"snapshot": "nightly-2018.09.06",
+			"state": "SUCCESS",
+			"start_time_in_millis": 1536243158017,
+			"end_time_in_millis": 1536243278017,
+			"duration_in_millis": 120000,
+			"shards": { "total": 5, "failed": 0, "successful": 5 }
+		},
+		{
+			"snapshot": "nightly-2018.09.07",
+			"state": "FAILED",
+			"start_time_in_millis": 1536329558017,
+			"end_time_in_millis": 1536329618017,
+			"duration_in_millis": 60000,
+			"shards": { "total": 5, "failed": 5, "successful": 0 }
+		}
+	]
+}`)
+
 var jsonUnknowRepostitory = []byte(`{
 	"error": {
 	  "root_cause": [
@@ -46,18 +114,38 @@ func setupTest(t *testing.T, json []byte, status int) (*ElasticSearchRepo, func(
 	}
 }
 
+// Serves the listing of the snapshots and their status
+func setupSnapshotsTest(t *testing.T) (*ElasticSearchRepo, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_snapshot/my_backup/_all":
+			w.Write(jsonAll)
+		case "/_snapshot/my_backup/nightly-2018.09.06/_status":
+			w.Write(jsonOk)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(jsonUnknowRepostitory)
+		}
+	}))
+
+	esRepo := OpenRepository("testRepo", ts.URL, "my_backup")
+	return esRepo, func() {
+		ts.Close()
+	}
+}
+
 func TestLatestSnapshot(t *testing.T) {
 	t.Log("Testing a success case ")
-	repo, teardown := setupTest(t, jsonOk, http.StatusOK)
+	repo, teardown := setupSnapshotsTest(t)
 	defer teardown()
 
-	elasticSearchSnapshot, esError := repo.LatestSnapshot()
+	elasticSearchSnapshot, esError := repo.LatestSnapshot(context.Background())
 	if esError != nil {
 		t.Fatalf("Unexpected error: %s", esError.Error())
 	}
 
-	if elasticSearchSnapshot.Name != snapshotName {
-		t.Errorf("Name - Expected %s but got %s", snapshotName, elasticSearchSnapshot.Name)
+	if elasticSearchSnapshot.Name != "nightly-2018.09.06" {
+		t.Errorf("Name - Expected %s but got %s", "nightly-2018.09.06", elasticSearchSnapshot.Name)
 	}
 
 	if elasticSearchSnapshot.Size != float64(1371) {
@@ -69,10 +157,181 @@ func TestLatestSnapshot(t *testing.T) {
 	}
 }
 
+func TestLatestSnapshotMetrics(t *testing.T) {
+	t.Log("Testing the state, shard failures and duration of the latest snapshot")
+	repo, teardown := setupSnapshotsTest(t)
+	defer teardown()
+
+	snapshot, esError := repo.LatestSnapshot(context.Background())
+	if esError != nil {
+		t.Fatalf("Unexpected error: %s", esError.Error())
+	}
+
+	values := make(map[string]float64)
+	for _, metric := range snapshot.Metrics {
+		name := metric.Name
+		if state, ok := metric.Labels["state"]; ok {
+			name += "_" + state
+		}
+		values[name] = metric.Value
+	}
+
+	expected := map[string]float64{
+		"backup_last_snapshot_shard_failures":   2,
+		"backup_last_snapshot_duration_seconds": 120,
+		"backup_last_snapshot_state_PARTIAL":    1,
+		"backup_last_snapshot_state_SUCCESS":    0,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("Expected %s %v but got %v", name, value, values[name])
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	t.Log("Testing the sizes of the snapshot history")
+	sizes := map[string]float64{"nightly-2018.09.05": 1024, "nightly-2018.09.06": 1371, "manual-2018.09.06": 512}
+	var statusRequests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_snapshot/my_backup/_all" {
+			w.Write(jsonAll)
+			return
+		}
+
+		statusRequests++
+		names := strings.Split(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/_snapshot/my_backup/"), "/_status"), ",")
+		var snapshots []string
+		for _, name := range names {
+			snapshots = append(snapshots, fmt.Sprintf(`{"snapshot": %q, "stats": {"total_size_in_bytes": %v}}`, name, sizes[name]))
+		}
+		fmt.Fprintf(w, `{"snapshots": [%s]}`, strings.Join(snapshots, ","))
+	}))
+	defer ts.Close()
+
+	repo := OpenRepository("testRepo", ts.URL, "my_backup")
+	report, esError := repo.Report(context.Background())
+	if esError != nil {
+		t.Fatalf("Unexpected error: %s", esError.Error())
+	}
+
+	// The running snapshot is left out of the history
+	if report.Latest.Size != 1371 || len(report.Snapshots) != 3 {
+		t.Fatalf("Expected the latest snapshot and the 3 restorable snapshots but got %v and %v", report.Latest, report.Snapshots)
+	}
+	for _, snapshot := range report.Snapshots {
+		if snapshot.Size != sizes[snapshot.Name] {
+			t.Errorf("Size of %s - Expected %f but got %f", snapshot.Name, sizes[snapshot.Name], snapshot.Size)
+		}
+	}
+
+	// The sizes are kept by the following refreshes
+	statusRequests = 0
+	if _, esError := repo.Report(context.Background()); esError != nil {
+		t.Fatalf("Unexpected error: %s", esError.Error())
+	}
+	if statusRequests != 0 {
+		t.Errorf("Expected the sizes to be kept but got %d status requests", statusRequests)
+	}
+}
+
+func TestLatestSnapshotFailed(t *testing.T) {
+	t.Log("Testing a failed snapshot newer than the latest successful one")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_snapshot/my_backup/_all":
+			w.Write(jsonFailed)
+		case "/_snapshot/my_backup/nightly-2018.09.06/_status":
+			w.Write(jsonOk)
+		default:
+			w.Write([]byte(`{"snapshots": []}`))
+		}
+	}))
+	defer ts.Close()
+
+	repo := OpenRepository("testRepo", ts.URL, "my_backup")
+	snapshot, esError := repo.LatestSnapshot(context.Background())
+	if esError != nil {
+		t.Fatalf("Unexpected error: %s", esError.Error())
+	}
+
+	if snapshot.Name != "nightly-2018.09.06" {
+		t.Errorf("Name - Expected the successful snapshot %s but got %s", "nightly-2018.09.06", snapshot.Name)
+	}
+
+	// The failed snapshot is left out of the history
+	snapshots, esError := repo.Snapshots(context.Background())
+	if esError != nil {
+		t.Fatalf("Unexpected error: %s", esError.Error())
+	}
+	if len(snapshots) != 1 || snapshots[0].Name != "nightly-2018.09.06" {
+		t.Errorf("Expected the successful snapshot only but got %v", snapshots)
+	}
+
+	values := make(map[string]float64)
+	for _, metric := range snapshot.Metrics {
+		values[metric.Name+"_"+metric.Labels["state"]] = metric.Value
+	}
+	expected := map[string]float64{
+		"backup_last_snapshot_state_SUCCESS":   1,
+		"backup_last_snapshot_state_FAILED":    0,
+		"backup_newest_snapshot_state_SUCCESS": 0,
+		"backup_newest_snapshot_state_FAILED":  1,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("Expected %s %v but got %v", name, value, values[name])
+		}
+	}
+}
+
+func TestLatestSnapshotPattern(t *testing.T) {
+	t.Log("Testing the filtering of the snapshots by name")
+	repo, teardown := setupSnapshotsTest(t)
+	defer teardown()
+
+	repo.Pattern = "^manual-"
+	snapshots, esError := repo.Snapshots(context.Background())
+	if esError != nil {
+		t.Fatalf("Unexpected error: %s", esError.Error())
+	}
+	if len(snapshots) != 1 || snapshots[0].Name != "manual-2018.09.06" {
+		t.Errorf("Expected the manual snapshot only but got %v", snapshots)
+	}
+
+	// The status of the manual snapshot is not served
+	if _, esError := repo.LatestSnapshot(context.Background()); esError != collector.ErrSnapshotNotFound {
+		t.Errorf("Expected the status of the manual snapshot to be queried but got %v", esError)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	t.Log("Testing the listing of all the snapshots")
+	repo, teardown := setupTest(t, jsonAll, http.StatusOK)
+	defer teardown()
+
+	snapshots, esError := repo.Snapshots(context.Background())
+	if esError != nil {
+		t.Fatalf("Unexpected error: %s", esError.Error())
+	}
+
+	if len(snapshots) != 3 {
+		t.Fatalf("Expected the 3 restorable snapshots but got %d", len(snapshots))
+	}
+
+	if snapshots[1].Name != "nightly-2018.09.06" {
+		t.Errorf("Name - Expected %s but got %s", "nightly-2018.09.06", snapshots[1].Name)
+	}
+
+	if snapshots[1].DateString != "Thu Sep  6 14:12:38 UTC 2018" {
+		t.Errorf("TimeInMillis - Expected %s but got %s", "Thu Sep  6 14:12:38 UTC 2018", snapshots[1].DateString)
+	}
+}
+
 func TestLatestSnapshotUnknowURL(t *testing.T) {
 	t.Log("Testing an unknow URL")
 	repo := OpenRepository("testRepo", "", "my_backup")
-	_, err := repo.LatestSnapshot()
+	_, err := repo.LatestSnapshot(context.Background())
 	if err == nil {
 		t.Errorf("Expected an error")
 	}
@@ -84,8 +343,40 @@ func TestLatestSnapshotUnknowRespository(t *testing.T) {
 	repo, teardown := setupTest(t, jsonUnknowRepostitory, http.StatusNotFound)
 	defer teardown()
 
-	_, esError := repo.LatestSnapshot()
+	_, esError := repo.LatestSnapshot(context.Background())
 	if esError == nil {
 		t.Errorf("Expected an error")
 	}
 }
+
+func TestLatestSnapshotUnauthorized(t *testing.T) {
+	t.Log("Testing rejected credentials")
+
+	repo, teardown := setupTest(t, []byte(`{"status": 401}`), http.StatusUnauthorized)
+	defer teardown()
+
+	_, esError := repo.LatestSnapshot(context.Background())
+	if esError != collector.ErrAuthentication {
+		t.Errorf("Expected %v but got %v", collector.ErrAuthentication, esError)
+	}
+}
+
+func TestLatestSnapshotTimeout(t *testing.T) {
+	t.Log("Testing a request exceeding the context deadline")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	repo := OpenRepository("testRepo", ts.URL, "my_backup")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, esError := repo.LatestSnapshot(ctx)
+	if esError == nil {
+		t.Fatalf("Expected an error")
+	}
+}
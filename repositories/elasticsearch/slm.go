@@ -0,0 +1,219 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+// Flavors of the cluster, selecting the snapshot policy API
+const (
+	FlavorElasticsearch = "elasticsearch"
+	FlavorOpenSearch    = "opensearch"
+)
+
+// Represents a policy as returned by the Elasticsearch _slm/policy endpoint
+type slmPolicy struct {
+	Policy struct {
+		Repository string `json:"repository"`
+	} `json:"policy"`
+	LastSuccess *struct {
+		Time int64 `json:"time"`
+	} `json:"last_success"`
+	LastFailure *struct {
+		Time int64 `json:"time"`
+	} `json:"last_failure"`
+	NextExecutionMillis int64 `json:"next_execution_millis"`
+}
+
+type slmStats struct {
+	PolicyStats []struct {
+		Policy          string  `json:"policy"`
+		SnapshotsFailed float64 `json:"snapshots_failed"`
+	} `json:"policy_stats"`
+}
+
+// Represents the policies as returned by the OpenSearch _plugins/_sm/policies endpoint
+type smPolicies struct {
+	Policies []struct {
+		Id       string `json:"_id"`
+		SMPolicy struct {
+			Name           string `json:"name"`
+			SnapshotConfig struct {
+				Repository string `json:"repository"`
+			} `json:"snapshot_config"`
+		} `json:"sm_policy"`
+	} `json:"policies"`
+}
+
+type smExplain struct {
+	Policies []struct {
+		Name     string `json:"name"`
+		Creation struct {
+			Trigger struct {
+				Time int64 `json:"time"`
+			} `json:"trigger"`
+			LatestExecution *struct {
+				Status    string `json:"status"`
+				StartTime int64  `json:"start_time"`
+				EndTime   int64  `json:"end_time"`
+			} `json:"latest_execution"`
+		} `json:"creation"`
+	} `json:"policies"`
+}
+
+// Represents the state of a snapshot policy, the times are in milliseconds
+// and zero when unknown
+type policyState struct {
+	name                     string
+	lastSuccess, lastFailure int64
+	nextExecution            int64
+	failures                 *float64
+}
+
+func (policy *policyState) metrics() []collector.Metric {
+	var metrics []collector.Metric
+	labels := map[string]string{"policy": policy.name}
+	timestamps := []struct {
+		name, help string
+		millis     int64
+	}{
+		{"backup_policy_last_success_timestamp_seconds", "The time of the latest successful snapshot of the policy", policy.lastSuccess},
+		{"backup_policy_last_failure_timestamp_seconds", "The time of the latest failed snapshot of the policy", policy.lastFailure},
+		{"backup_policy_next_execution_timestamp_seconds", "The time of the next snapshot of the policy", policy.nextExecution},
+	}
+	for _, timestamp := range timestamps {
+		if timestamp.millis > 0 {
+			metrics = append(metrics, collector.Metric{
+				Name: timestamp.name, Help: timestamp.help, Labels: labels,
+				Value: float64(timestamp.millis) / 1000,
+			})
+		}
+	}
+	if policy.failures != nil {
+		metrics = append(metrics, collector.Metric{
+			Name: "backup_policy_failures", Help: "The number of snapshots of the policy that failed",
+			Labels: labels, Value: *policy.failures,
+		})
+	}
+	return metrics
+}
+
+// Returns an error for an unknown flavor
+func (er *ElasticSearchRepo) Validate() error {
+	switch strings.ToLower(er.Flavor) {
+	case "", FlavorElasticsearch, FlavorOpenSearch:
+		return nil
+	}
+	return fmt.Errorf("unknown flavor %q, must be %s or %s", er.Flavor, FlavorElasticsearch, FlavorOpenSearch)
+}
+
+// Returns the metrics of the snapshot policies targeting the repository
+func (er *ElasticSearchRepo) policyMetrics(ctx context.Context) ([]collector.Metric, error) {
+	if !er.Policies {
+		return nil, nil
+	}
+
+	var policies []*policyState
+	var err error
+	switch strings.ToLower(er.Flavor) {
+	case "", FlavorElasticsearch:
+		policies, err = er.slmPolicies(ctx)
+	case FlavorOpenSearch:
+		policies, err = er.smPolicies(ctx)
+	default:
+		return nil, fmt.Errorf("unknown flavor %q", er.Flavor)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].name < policies[j].name
+	})
+	var metrics []collector.Metric
+	for _, policy := range policies {
+		metrics = append(metrics, policy.metrics()...)
+	}
+	return metrics, nil
+}
+
+// Reads the Elasticsearch Snapshot Lifecycle Management policies
+func (er *ElasticSearchRepo) slmPolicies(ctx context.Context) ([]*policyState, error) {
+	query := make(map[string]*slmPolicy)
+	if err := er.get(ctx, &query, "_slm", "policy"); err != nil {
+		return nil, err
+	}
+
+	stats := &slmStats{}
+	if err := er.get(ctx, stats, "_slm", "stats"); err != nil {
+		return nil, err
+	}
+	failures := make(map[string]float64)
+	for _, policy := range stats.PolicyStats {
+		failures[policy.Policy] = policy.SnapshotsFailed
+	}
+
+	var policies []*policyState
+	for name, policy := range query {
+		if policy.Policy.Repository != er.Repo {
+			continue
+		}
+		state := &policyState{name: name, nextExecution: policy.NextExecutionMillis}
+		if policy.LastSuccess != nil {
+			state.lastSuccess = policy.LastSuccess.Time
+		}
+		if policy.LastFailure != nil {
+			state.lastFailure = policy.LastFailure.Time
+		}
+		count := failures[name]
+		state.failures = &count
+		policies = append(policies, state)
+	}
+	return policies, nil
+}
+
+// Reads the OpenSearch Snapshot Management policies, which only keep their
+// latest execution so their failures are not counted
+func (er *ElasticSearchRepo) smPolicies(ctx context.Context) ([]*policyState, error) {
+	query := &smPolicies{}
+	if err := er.get(ctx, query, "_plugins", "_sm", "policies"); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, policy := range query.Policies {
+		if policy.SMPolicy.SnapshotConfig.Repository == er.Repo {
+			names = append(names, policy.SMPolicy.Name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	explain := &smExplain{}
+	if err := er.get(ctx, explain, "_plugins", "_sm", "policies", strings.Join(names, ","), "_explain"); err != nil {
+		return nil, err
+	}
+
+	var policies []*policyState
+	for _, policy := range explain.Policies {
+		state := &policyState{name: policy.Name, nextExecution: policy.Creation.Trigger.Time}
+		if execution := policy.Creation.LatestExecution; execution != nil {
+			switch execution.Status {
+			case "SUCCESS":
+				state.lastSuccess = execution.EndTime
+			case "FAILED", "TIME_LIMIT_EXCEEDED":
+				state.lastFailure = execution.EndTime
+				if state.lastFailure == 0 {
+					state.lastFailure = execution.StartTime
+				}
+			}
+		}
+		policies = append(policies, state)
+	}
+	return policies, nil
+}
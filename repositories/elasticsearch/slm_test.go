@@ -0,0 +1,167 @@
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var jsonSLMPolicy = []byte(`{
+	"nightly-snapshots": {
+		"version": 1,
+		"policy": { "name": "<nightly-{now/d}>", "schedule": "0 30 1 * * ?", "repository": "my_backup" },
+		"last_success": { "snapshot_name": "nightly-2018.09.06", "time": 1536243278017 },
+		"last_failure": { "snapshot_name": "nightly-2018.09.05", "time": 1536156818017, "details": "failed" },
+		"next_execution_millis": 1536283800000
+	},
+	"other-repository": {
+		"version": 1,
+		"policy": { "name": "<other-{now/d}>", "schedule": "0 30 1 * * ?", "repository": "other" },
+		"next_execution_millis": 1536283800000
+	}
+}`)
+
+var jsonSLMStats = []byte(`{
+	"total_snapshots_taken": 12,
+	"total_snapshots_failed": 3,
+	"policy_stats": [
+		{ "policy": "nightly-snapshots", "snapshots_taken": 10, "snapshots_failed": 2 },
+		{ "policy": "other-repository", "snapshots_taken": 2, "snapshots_failed": 1 }
+	]
+}`)
+
+var jsonSMPolicies = []byte(`{
+	"policies": [
+		{ "_id": "daily-policy-sm-policy", "sm_policy": { "name": "daily-policy", "snapshot_config": { "repository": "my_backup" } } },
+		{ "_id": "other-sm-policy", "sm_policy": { "name": "other", "snapshot_config": { "repository": "other" } } }
+	],
+	"total_policies": 2
+}`)
+
+var jsonSMExplain = []byte(`{
+	"policies": [
+		{
+			"name": "daily-policy",
+			"creation": {
+				"current_state": "CREATION_START",
+				"trigger": { "time": 1536283800000 },
+				"latest_execution": { "status": "FAILED", "start_time": 1536156758017, "end_time": 1536156818017 }
+			},
+			"enabled": true
+		}
+	]
+}`)
+
+// Serves the snapshots along with the policy APIs of both flavors
+func setupPoliciesTest(t *testing.T) (*ElasticSearchRepo, func()) {
+	routes := map[string][]byte{
+		"/_snapshot/my_backup/_all":                       jsonAll,
+		"/_snapshot/my_backup/nightly-2018.09.06/_status": jsonOk,
+		"/_slm/policy":           jsonSLMPolicy,
+		"/_slm/stats":            jsonSLMStats,
+		"/_plugins/_sm/policies": jsonSMPolicies,
+		"/_plugins/_sm/policies/daily-policy/_explain": jsonSMExplain,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := routes[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(jsonUnknowRepostitory)
+			return
+		}
+		w.Write(body)
+	}))
+
+	esRepo := OpenRepository("testRepo", ts.URL, "my_backup")
+	esRepo.Policies = true
+	return esRepo, func() {
+		ts.Close()
+	}
+}
+
+// Returns the values of the policy metrics by name and policy
+func policyValues(metrics []collector.Metric) map[string]float64 {
+	values := make(map[string]float64)
+	for _, metric := range metrics {
+		if policy, ok := metric.Labels["policy"]; ok {
+			values[metric.Name+"/"+policy] = metric.Value
+		}
+	}
+	return values
+}
+
+func TestSLMPolicies(t *testing.T) {
+	t.Log("Testing the Snapshot Lifecycle Management policies of Elasticsearch")
+	repo, teardown := setupPoliciesTest(t)
+	defer teardown()
+
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	values := policyValues(snapshot.Metrics)
+	expected := map[string]float64{
+		"backup_policy_last_success_timestamp_seconds/nightly-snapshots":   1536243278.017,
+		"backup_policy_last_failure_timestamp_seconds/nightly-snapshots":   1536156818.017,
+		"backup_policy_next_execution_timestamp_seconds/nightly-snapshots": 1536283800,
+		"backup_policy_failures/nightly-snapshots":                         2,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("Expected %s %v but got %v", name, value, values[name])
+		}
+	}
+	if len(values) != len(expected) {
+		t.Errorf("Expected only the policies of the repository but got %v", values)
+	}
+}
+
+func TestSMPolicies(t *testing.T) {
+	t.Log("Testing the Snapshot Management policies of OpenSearch")
+	repo, teardown := setupPoliciesTest(t)
+	defer teardown()
+	repo.Flavor = FlavorOpenSearch
+
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	values := policyValues(snapshot.Metrics)
+	expected := map[string]float64{
+		"backup_policy_last_failure_timestamp_seconds/daily-policy":   1536156818.017,
+		"backup_policy_next_execution_timestamp_seconds/daily-policy": 1536283800,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("Expected %s %v but got %v", name, value, values[name])
+		}
+	}
+	if len(values) != len(expected) {
+		t.Errorf("Expected only the policies of the repository but got %v", values)
+	}
+
+	repo.Flavor = "unknown"
+	if err := repo.Validate(); err == nil {
+		t.Errorf("Expected an error for an unknown flavor")
+	}
+}
+
+func TestPoliciesFailure(t *testing.T) {
+	t.Log("Testing a cluster failing to report its policies")
+	repo, teardown := setupSnapshotsTest(t)
+	defer teardown()
+	repo.Policies = true
+
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if values := policyValues(snapshot.Metrics); len(values) != 0 {
+		t.Errorf("Expected no policy metrics but got %v", values)
+	}
+}
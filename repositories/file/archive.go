@@ -0,0 +1,313 @@
+package file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Represents the outcome of the verification of an archive
+type archiveResult struct {
+	valid   bool
+	entries float64
+}
+
+// Represents what the inspection of an archive does
+type inspectionOptions struct {
+	// Whether the archive is verified
+	verify bool
+	// The algorithm of the digest, nil when the archive is not hashed
+	algorithm *checksumAlgorithm
+	// Maximum bytes read per second while hashing, unlimited when zero
+	rate int64
+}
+
+// Represents the inspection of an archive, run in background as reading a
+// large archive may outlast the refresh timeout. The verification and the
+// hashing share a single read of the archive. It is only run again once the
+// archive, its modification time or its size changes, or once the hashing failed.
+type archiveInspection struct {
+	// The path of the inspected archive
+	path    string
+	modTime time.Time
+	size    int64
+	// The verification outcome, nil while running or when the format is not supported
+	result *archiveResult
+	// The digest of the archive, empty while running or when the hashing failed
+	digest string
+	// Whether the hashing failed
+	failed bool
+}
+
+// Holds the inspection of the latest archive of each repository, keyed by
+// the repository alias and the inspection options, so the inspections of
+// the rotated archives are dropped
+var archiveCache = struct {
+	sync.Mutex
+	inspections map[string]*archiveInspection
+}{inspections: make(map[string]*archiveInspection)}
+
+// Reader failing once the context is done, so inspections stop when cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Returns the verification and checksum metrics of the archive from its latest
+// inspection and starts a new one in background when the archive changed. They
+// are reported by the refreshes following the end of the inspection.
+func archiveMetrics(alias, path string, verify, checksum bool, rate int64) []collector.Metric {
+	options := inspectionOptions{verify: verify, rate: rate}
+	var expected string
+	if checksum {
+		var err error
+		expected, options.algorithm, err = expectedChecksum(path)
+		if err != nil {
+			log.Printf("failed to read the checksum of %s: %s", path, err.Error())
+			checksum = false
+		}
+	}
+
+	var metrics []collector.Metric
+	if checksum && options.algorithm == nil {
+		metrics = checksumMetrics(ChecksumMissing)
+	}
+	if !options.verify && options.algorithm == nil {
+		return metrics
+	}
+
+	inspection, err := startInspection(alias, path, options)
+	if err != nil {
+		log.Printf("archive %s is invalid: %s", path, err.Error())
+		if verify {
+			metrics = append(metrics, (&archiveResult{}).metrics()...)
+		}
+		return metrics
+	}
+	if inspection.result != nil {
+		metrics = append(metrics, inspection.result.metrics()...)
+	}
+	if inspection.digest != "" {
+		status := ChecksumMismatch
+		if inspection.digest == expected {
+			status = ChecksumMatch
+		}
+		metrics = append(metrics, checksumMetrics(status)...)
+	}
+	return metrics
+}
+
+// Returns a copy of the latest inspection of the latest archive of the repository,
+// started again in background when the archive changed or its hashing failed
+func startInspection(alias, path string, options inspectionOptions) (archiveInspection, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return archiveInspection{}, err
+	}
+
+	key := alias
+	if options.verify {
+		key += ":verify"
+	}
+	if options.algorithm != nil {
+		key += ":" + options.algorithm.name
+	}
+
+	archiveCache.Lock()
+	defer archiveCache.Unlock()
+	inspection, ok := archiveCache.inspections[key]
+	if !ok || inspection.path != path || !inspection.modTime.Equal(info.ModTime()) || inspection.size != info.Size() {
+		inspection = &archiveInspection{path: path, modTime: info.ModTime(), size: info.Size()}
+		archiveCache.inspections[key] = inspection
+		go inspection.run(path, options)
+	} else if inspection.failed {
+		// The verification outcome is still reported until the new inspection ends
+		inspection = &archiveInspection{path: path, modTime: info.ModTime(), size: info.Size(), result: inspection.result}
+		archiveCache.inspections[key] = inspection
+		go inspection.run(path, options)
+	}
+	return *inspection, nil
+}
+
+func (inspection *archiveInspection) run(path string, options inspectionOptions) {
+	result, digest, err := inspectArchive(context.Background(), path, options)
+	if err != nil {
+		log.Printf("failed to hash archive %s: %s", path, err.Error())
+	}
+	archiveCache.Lock()
+	inspection.result, inspection.digest, inspection.failed = result, digest, err != nil
+	archiveCache.Unlock()
+}
+
+// Reads the archive once, verifying it when asked and returning its digest when
+// an algorithm is given. Zip archives are read by entry to be verified, apart from
+// the hashing. The error is the one of the hashing, the verification failures
+// only make the archive invalid.
+func inspectArchive(ctx context.Context, path string, options inspectionOptions) (*archiveResult, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		var result *archiveResult
+		if options.verify {
+			log.Printf("archive %s is invalid: %s", path, err.Error())
+			result = &archiveResult{}
+		}
+		return result, "", err
+	}
+	defer file.Close()
+
+	var r io.Reader = &contextReader{ctx, file}
+	var h hash.Hash
+	if options.algorithm != nil {
+		h = options.algorithm.new()
+		r = io.TeeReader(&rateLimitedReader{ctx: ctx, r: file, rate: options.rate, start: time.Now()}, h)
+	}
+
+	var result *archiveResult
+	if options.verify {
+		result = verifyArchive(ctx, path, r)
+	}
+	if h == nil {
+		return result, "", nil
+	}
+
+	// The digest covers the data left unread by the verification as well
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return result, "", err
+	}
+	return result, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Reads the whole archive from r to check it is not corrupted, nil when its format is not supported
+func verifyArchive(ctx context.Context, path string, r io.Reader) *archiveResult {
+	result := &archiveResult{}
+	supported, err := result.verify(ctx, path, r)
+	if !supported {
+		return nil
+	}
+	if err != nil {
+		log.Printf("archive %s is invalid: %s", path, err.Error())
+	}
+	result.valid = err == nil
+	return result
+}
+
+func (result *archiveResult) metrics() []collector.Metric {
+	var valid float64
+	if result.valid {
+		valid = 1
+	}
+	return []collector.Metric{
+		{Name: "backup_archive_valid", Help: "1 when the latest archive could be read to the end, 0 otherwise", Value: valid},
+		{Name: "backup_archive_entries", Help: "The number of entries read from the latest archive", Value: result.entries},
+	}
+}
+
+// Reads the whole archive from r, or from its path for a zip archive, counting
+// its entries. Returns false when the format is not supported.
+func (result *archiveResult) verify(ctx context.Context, path string, r io.Reader) (bool, error) {
+	name := strings.ToLower(path)
+	if strings.HasSuffix(name, ".zip") {
+		return true, result.verifyZip(ctx, path)
+	}
+
+	var compressed, archived bool
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		archived = true
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"),
+		strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		compressed, archived = true, true
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".zst"):
+		compressed = true
+	default:
+		return false, nil
+	}
+
+	if compressed {
+		if strings.HasSuffix(name, ".zst") || strings.HasSuffix(name, ".tzst") {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return true, err
+			}
+			defer decoder.Close()
+			r = decoder
+		} else {
+			decoder, err := gzip.NewReader(r)
+			if err != nil {
+				return true, err
+			}
+			defer decoder.Close()
+			r = decoder
+		}
+	}
+
+	if !archived {
+		// A single compressed file, e.g. a database dump
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return true, err
+		}
+		result.entries = 1
+		return true, nil
+	}
+	return true, result.verifyTar(r)
+}
+
+func (result *archiveResult) verifyTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return err
+		}
+		result.entries++
+	}
+}
+
+func (result *archiveResult) verifyZip(ctx context.Context, path string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for _, entry := range archive.File {
+		r, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		// The checksum of the entry is verified once read to the end
+		_, err = io.Copy(ioutil.Discard, &contextReader{ctx, r})
+		r.Close()
+		if err != nil {
+			return err
+		}
+		result.entries++
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package file
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+	"github.com/klauspost/compress/zstd"
+)
+
+var archiveEntries = map[string]string{
+	"etc/hosts":  "127.0.0.1 localhost",
+	"etc/passwd": "root:x:0:0:root:/root:/bin/sh",
+	"var/data":   "some data",
+}
+
+func tarContent(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range archiveEntries {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func compressContent(t *testing.T, content []byte, newWriter func(w io.Writer) (io.WriteCloser, error)) []byte {
+	buf := &bytes.Buffer{}
+	w, err := newWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func zstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func zipContent(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, content := range archiveEntries {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func archiveValues(metrics []collector.Metric) map[string]float64 {
+	values := make(map[string]float64)
+	for _, metric := range metrics {
+		values[metric.Name] = metric.Value
+	}
+	return values
+}
+
+func TestVerifyArchive(t *testing.T) {
+	t.Log("Testing the verification of valid and truncated archives")
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tarGz := compressContent(t, tarContent(t), gzipWriter)
+	tarZst := compressContent(t, tarContent(t), zstdWriter)
+	tests := []struct {
+		name    string
+		content []byte
+		valid   float64
+		entries float64
+	}{
+		{"backup.tar", tarContent(t), 1, 3},
+		{"backup.tar.gz", tarGz, 1, 3},
+		{"backup.tar.zst", tarZst, 1, 3},
+		{"backup.zip", zipContent(t), 1, 3},
+		{"dump.sql.gz", compressContent(t, []byte("CREATE TABLE t;"), gzipWriter), 1, 1},
+		{"truncated.tar.gz", tarGz[:len(tarGz)/2], 0, 0},
+		{"truncated.tar.zst", tarZst[:len(tarZst)-8], 0, 0},
+		{"truncated.zip", zipContent(t)[:100], 0, 0},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(path, test.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		result, _, err := inspectArchive(context.Background(), path, inspectionOptions{verify: true})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", test.name, err.Error())
+		}
+		if result == nil {
+			t.Fatalf("Expected %s to be supported", test.name)
+		}
+		values := archiveValues(result.metrics())
+		if values["backup_archive_valid"] != test.valid || values["backup_archive_entries"] < test.entries {
+			t.Errorf("Expected %s to be valid %v with %v entries but got %v", test.name, test.valid, test.entries, values)
+		}
+	}
+
+	path := filepath.Join(dir, "backup.txt")
+	if err := ioutil.WriteFile(path, []byte("text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if result, _, _ := inspectArchive(context.Background(), path, inspectionOptions{verify: true}); result != nil {
+		t.Errorf("Expected no result for an unsupported format but got %v", result)
+	}
+}
+
+// Returns the archive metrics once the background inspection reports count of them
+func waitArchiveMetrics(t *testing.T, path string, verify, checksum bool, count int) []collector.Metric {
+	for i := 0; i < 100; i++ {
+		if metrics := archiveMetrics("testRepo", path, verify, checksum, 0); len(metrics) >= count {
+			return metrics
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Expected the inspection of %s to end", path)
+	return nil
+}
+
+func TestVerifyArchiveCache(t *testing.T) {
+	t.Log("Testing that archives are verified in background and only again once they change")
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup.tar.gz")
+	content := compressContent(t, tarContent(t), gzipWriter)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if values := archiveValues(waitArchiveMetrics(t, path, true, false, 2)); values["backup_archive_valid"] != 1 {
+		t.Errorf("Expected a valid archive but got %v", values)
+	}
+
+	// Corrupted in place, keeping the same size and modification time
+	corrupted := make([]byte, len(content))
+	if err := ioutil.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if values := archiveValues(archiveMetrics("testRepo", path, true, false, 0)); values["backup_archive_valid"] != 1 {
+		t.Errorf("Expected the cached result but got %v", values)
+	}
+
+	if err := os.Chtimes(path, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if metrics := archiveMetrics("testRepo", path, true, false, 0); metrics != nil {
+		t.Errorf("Expected no metrics while the modified archive is verified but got %v", metrics)
+	}
+	if values := archiveValues(waitArchiveMetrics(t, path, true, false, 2)); values["backup_archive_valid"] != 0 {
+		t.Errorf("Expected the modified archive to be verified again but got %v", values)
+	}
+
+	// A corrupted archive does not fail the refresh
+	repo := OpenRepository("testRepo", dir, ".tar.gz")
+	repo.Verify = true
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := archiveValues(snapshot.Metrics); len(values) != 2 || values["backup_archive_valid"] != 0 {
+		t.Errorf("Expected the archive metrics on the latest snapshot but got %v", values)
+	}
+}
+
+func TestArchiveCacheRotation(t *testing.T) {
+	t.Log("Testing that only the inspection of the latest archive of a repository is kept")
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := compressContent(t, tarContent(t), gzipWriter)
+	for _, name := range []string{"backup-1.tar.gz", "backup-2.tar.gz"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if values := archiveValues(waitArchiveMetrics(t, path, true, false, 2)); values["backup_archive_valid"] != 1 {
+			t.Errorf("%s - Expected a valid archive but got %v", name, values)
+		}
+	}
+
+	archiveCache.Lock()
+	defer archiveCache.Unlock()
+	var paths []string
+	for _, inspection := range archiveCache.inspections {
+		if filepath.Dir(inspection.path) == dir {
+			paths = append(paths, inspection.path)
+		}
+	}
+	if len(paths) != 1 || paths[0] != filepath.Join(dir, "backup-2.tar.gz") {
+		t.Errorf("Expected only the inspection of backup-2.tar.gz but got %v", paths)
+	}
+}
@@ -0,0 +1,179 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+// Outcomes of the checksum verification, exported by the backup_checksum_status metric
+const (
+	ChecksumMatch    = "match"
+	ChecksumMismatch = "mismatch"
+	ChecksumMissing  = "missing"
+)
+
+var checksumStatuses = []string{ChecksumMatch, ChecksumMismatch, ChecksumMissing}
+
+// Represents a supported checksum algorithm, along with the sidecar
+// extensions and the manifests holding its checksums
+type checksumAlgorithm struct {
+	name       string
+	new        func() hash.Hash
+	extensions []string
+	manifests  []string
+}
+
+var checksumAlgorithms = []checksumAlgorithm{
+	{"SHA256", sha256.New, []string{".sha256", ".sha256sum"}, []string{"SHA256SUMS", "sha256sums.txt"}},
+	{"MD5", md5.New, []string{".md5", ".md5sum"}, []string{"MD5SUMS", "md5sums.txt"}},
+}
+
+// Returns whether the file is a sidecar or a manifest, which are not snapshots
+func isChecksumFile(name string) bool {
+	for _, algorithm := range checksumAlgorithms {
+		for _, extension := range algorithm.extensions {
+			if strings.HasSuffix(name, extension) {
+				return true
+			}
+		}
+		for _, manifest := range algorithm.manifests {
+			if name == manifest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the expected checksum of the archive from its sidecar, or else from
+// a manifest of its directory, and its algorithm. Empty when there is none.
+func expectedChecksum(path string) (string, *checksumAlgorithm, error) {
+	for i := range checksumAlgorithms {
+		algorithm := &checksumAlgorithms[i]
+		for _, extension := range algorithm.extensions {
+			checksum, err := readChecksum(path+extension, "")
+			if err != nil {
+				return "", nil, err
+			}
+			if checksum != "" {
+				return checksum, algorithm, nil
+			}
+		}
+	}
+
+	for i := range checksumAlgorithms {
+		algorithm := &checksumAlgorithms[i]
+		for _, manifest := range algorithm.manifests {
+			checksum, err := readChecksum(filepath.Join(filepath.Dir(path), manifest), filepath.Base(path))
+			if err != nil {
+				return "", nil, err
+			}
+			if checksum != "" {
+				return checksum, algorithm, nil
+			}
+		}
+	}
+	return "", nil, nil
+}
+
+// Reads the checksum of the file from a checksum file, either in the GNU format
+// "<checksum>  <name>" or the BSD one "SHA256 (<name>) = <checksum>". A sidecar,
+// when name is empty, holds a single checksum whatever the file name.
+func readChecksum(checksumFile, name string) (string, error) {
+	file, err := os.Open(checksumFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var checksum, fileName string
+		if open := strings.Index(line, " ("); open > 0 && strings.Contains(line, ") = ") {
+			closing := strings.LastIndex(line, ") = ")
+			fileName = line[open+2 : closing]
+			checksum = line[closing+4:]
+		} else {
+			fields := strings.SplitN(line, " ", 2)
+			checksum = fields[0]
+			if len(fields) == 2 {
+				fileName = strings.TrimLeft(strings.TrimSpace(fields[1]), "*")
+			}
+		}
+
+		if name == "" || filepath.Base(fileName) == name {
+			return strings.ToLower(checksum), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// Reader sleeping as needed to stay below the given bytes per second
+type rateLimitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if err := l.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if l.rate > 0 && int64(len(p)) > l.rate {
+		p = p[:l.rate]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.rate > 0 {
+		expected := time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second))
+		if wait := expected - time.Since(l.start); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-l.ctx.Done():
+				return n, l.ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	return n, err
+}
+
+// Returns the checksum metrics for the outcome of the verification
+func checksumMetrics(status string) []collector.Metric {
+	var metrics []collector.Metric
+	for _, s := range checksumStatuses {
+		var value float64
+		if s == status {
+			value = 1
+		}
+		metrics = append(metrics, collector.Metric{
+			Name:   "backup_checksum_status",
+			Help:   "1 for the outcome of the checksum verification of the latest archive, 0 for the others",
+			Labels: map[string]string{"status": s},
+			Value:  value,
+		})
+	}
+	return metrics
+}
@@ -0,0 +1,159 @@
+package file
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+func checksumStatus(metrics []collector.Metric) string {
+	for _, metric := range metrics {
+		if metric.Name == "backup_checksum_status" && metric.Value == 1 {
+			return metric.Labels["status"]
+		}
+	}
+	return ""
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	t.Log("Testing the verification against sidecars and manifests")
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("backup content")
+	sha := sha256.Sum256(content)
+	md := md5.Sum(content)
+	shaHex, mdHex := hex.EncodeToString(sha[:]), hex.EncodeToString(md[:])
+
+	files := map[string]string{
+		"sidecar.tar.gz":          string(content),
+		"sidecar.tar.gz.sha256":   shaHex + "  sidecar.tar.gz\n",
+		"md5.tar.gz":              string(content),
+		"md5.tar.gz.md5":          mdHex + "\n",
+		"corrupted.tar.gz":        "truncated",
+		"corrupted.tar.gz.sha256": shaHex + "\n",
+		"manifest.tar.gz":         string(content),
+		"bsd.tar.gz":              string(content),
+		"missing.tar.gz":          string(content),
+		"SHA256SUMS":              "0000  other.tar.gz\n" + shaHex + " *manifest.tar.gz\n",
+		"MD5SUMS":                 "MD5 (bsd.tar.gz) = " + mdHex + "\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		"sidecar.tar.gz":   ChecksumMatch,
+		"md5.tar.gz":       ChecksumMatch,
+		"corrupted.tar.gz": ChecksumMismatch,
+		"manifest.tar.gz":  ChecksumMatch,
+		"bsd.tar.gz":       ChecksumMatch,
+		"missing.tar.gz":   ChecksumMissing,
+	}
+	for name, status := range expected {
+		metrics := waitArchiveMetrics(t, filepath.Join(dir, name), false, true, len(checksumStatuses))
+		if s := checksumStatus(metrics); s != status {
+			t.Errorf("Expected %s for %s but got %s", status, name, s)
+		}
+	}
+
+	repo := OpenRepository("testRepo", dir, "")
+	repo.Checksum = true
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, snapshot := range snapshots {
+		if isChecksumFile(snapshot.Name) {
+			t.Errorf("Expected the checksum files to be skipped but got %s", snapshot.Name)
+		}
+	}
+}
+
+func TestChecksumRate(t *testing.T) {
+	t.Log("Testing the rate limit of the hashing")
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup.tar.gz")
+	if err := ioutil.WriteFile(path, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := inspectionOptions{algorithm: &checksumAlgorithms[0], rate: 8192}
+	start := time.Now()
+	if _, _, err := inspectArchive(context.Background(), path, options); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected 4096 bytes at 8192 bytes per second to take about 500ms but took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	options.rate = 1024
+	if _, _, err := inspectArchive(ctx, path, options); err == nil {
+		t.Errorf("Expected the hashing to stop at the deadline")
+	}
+}
+
+func TestInspectArchive(t *testing.T) {
+	t.Log("Testing the verification and the hashing of archives from a single read")
+	dir, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := inspectionOptions{verify: true, algorithm: &checksumAlgorithms[0]}
+	for name, content := range map[string][]byte{
+		"backup.tar.gz":  compressContent(t, tarContent(t), gzipWriter),
+		"backup.tar.zst": compressContent(t, tarContent(t), zstdWriter),
+		"backup.zip":     zipContent(t),
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		result, digest, err := inspectArchive(context.Background(), path, options)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", name, err.Error())
+		}
+		sha := sha256.Sum256(content)
+		if result == nil || !result.valid || digest != hex.EncodeToString(sha[:]) {
+			t.Errorf("Expected %s to be valid with the digest %x but got %v %s", name, sha, result, digest)
+		}
+	}
+
+	// Reading a directory fails, the archive is invalid and has no checksum status
+	path := filepath.Join(dir, "directory.tar.gz")
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".sha256", []byte("0000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metrics := waitArchiveMetrics(t, path, true, true, 2)
+	if values := archiveValues(metrics); values["backup_archive_valid"] != 0 {
+		t.Errorf("Expected an invalid archive but got %v", values)
+	}
+	if status := checksumStatus(metrics); status != "" {
+		t.Errorf("Expected no checksum status when the hashing failed but got %s", status)
+	}
+}
@@ -0,0 +1,106 @@
+package file
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Represents a filename time layout, e.g. db-%Y%m%d-%H%M.sql.gz, used to
+// take the snapshot time from the file name instead of its modification time
+type timeLayout struct {
+	re *regexp.Regexp
+	// The directive of each capture group of the expression, e.g. Y
+	directives []byte
+}
+
+// Expressions matched by the supported directives
+var layoutDirectives = map[byte]string{
+	'Y': `(\d{4})`,
+	'y': `(\d{2})`,
+	'm': `(\d{2})`,
+	'd': `(\d{2})`,
+	'H': `(\d{2})`,
+	'M': `(\d{2})`,
+	'S': `(\d{2})`,
+}
+
+// Compiles the layout: %Y, %y, %m, %d, %H, %M and %S stand for the time
+// components, %% for a percent sign and * for any text
+func compileTimeLayout(layout string) (*timeLayout, error) {
+	l := &timeLayout{}
+	expression := &strings.Builder{}
+	expression.WriteString("^")
+	for i := 0; i < len(layout); i++ {
+		switch c := layout[i]; {
+		case c == '*':
+			expression.WriteString(".*")
+		case c != '%':
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		case i+1 == len(layout):
+			return nil, fmt.Errorf("time layout %q ends with %%", layout)
+		default:
+			i++
+			if layout[i] == '%' {
+				expression.WriteString("%")
+				continue
+			}
+			directive, ok := layoutDirectives[layout[i]]
+			if !ok {
+				return nil, fmt.Errorf("unknown directive %%%c in time layout %q", layout[i], layout)
+			}
+			expression.WriteString(directive)
+			l.directives = append(l.directives, layout[i])
+		}
+	}
+	expression.WriteString("$")
+
+	var err error
+	l.re, err = regexp.Compile(expression.String())
+	return l, err
+}
+
+// Returns the time held by the file name in local time, false when it does not match the layout
+func (l *timeLayout) parse(name string) (time.Time, bool) {
+	match := l.re.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, false
+	}
+
+	year, month, day := 1, 1, 1
+	var hour, minute, second int
+	for i, directive := range l.directives {
+		value, err := strconv.Atoi(match[i+1])
+		if err != nil {
+			return time.Time{}, false
+		}
+		switch directive {
+		case 'Y':
+			year = value
+		case 'y':
+			year = 2000 + value
+		case 'm':
+			month = value
+		case 'd':
+			day = value
+		case 'H':
+			hour = value
+		case 'M':
+			minute = value
+		case 'S':
+			second = value
+		}
+	}
+
+	if hour > 23 || minute > 59 || second > 59 {
+		return time.Time{}, false
+	}
+	// time.Date normalizes the invalid dates, e.g. February 31 becomes March 2 or 3
+	t := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.Local)
+	if y, m, d := t.Date(); y != year || int(m) != month || d != day {
+		return time.Time{}, false
+	}
+	return t, true
+}
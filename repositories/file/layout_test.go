@@ -0,0 +1,43 @@
+package file
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeLayout(t *testing.T) {
+	tests := []struct {
+		layout, name string
+		expected     time.Time
+		ok           bool
+	}{
+		{"db-%Y%m%d-%H%M.sql.gz", "db-20180912-0917.sql.gz", time.Date(2018, 9, 12, 9, 17, 0, 0, time.Local), true},
+		{"%y-%m-%dT%H:%M:%S.tar", "18-09-12T09:17:07.tar", time.Date(2018, 9, 12, 9, 17, 7, 0, time.Local), true},
+		{"*_%Y-%m-%d.tar.gz", "host1_2018-09-12.tar.gz", time.Date(2018, 9, 12, 0, 0, 0, 0, time.Local), true},
+		{"100%%-%Y.zip", "100%-2018.zip", time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local), true},
+		{"db-%Y%m%d-%H%M.sql.gz", "db-20180912-0917.sql", time.Time{}, false},
+		{"db-%Y%m%d-%H%M.sql.gz", "db-20181312-0917.sql.gz", time.Time{}, false},
+		{"db-%Y%m%d.sql.gz", "xdb-20180912.sql.gz", time.Time{}, false},
+		{"db-%Y%m%d", "db-20240231", time.Time{}, false},
+		{"db-%Y%m%d", "db-20230229", time.Time{}, false},
+		{"db-%Y%m%d", "db-20240229", time.Date(2024, 2, 29, 0, 0, 0, 0, time.Local), true},
+		{"db-%Y%m%d", "db-20180900", time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		layout, err := compileTimeLayout(test.layout)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", test.layout, err.Error())
+		}
+		parsed, ok := layout.parse(test.name)
+		if ok != test.ok || !parsed.Equal(test.expected) {
+			t.Errorf("Expected %v %v for %s with %s but got %v %v", test.expected, test.ok, test.name, test.layout, parsed, ok)
+		}
+	}
+
+	for _, layout := range []string{"db-%Q", "db-%"} {
+		if _, err := compileTimeLayout(layout); err == nil {
+			t.Errorf("Expected an error for %s", layout)
+		}
+	}
+}
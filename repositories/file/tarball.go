@@ -1,8 +1,13 @@
 package file
 
 import (
-	"io/ioutil"
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -19,6 +24,159 @@ type TarballRepo struct {
 	Path,
 	// The extension of the files to be checked
 	Extension string
+
+	// Also scans the subdirectories of the path
+	Recursive bool
+	// Optional - globs the files must match, any of them, e.g. db-*.sql.gz.
+	// They are matched against the path relative to the repository and the file name.
+	Include []string
+	// Optional - globs the files must not match
+	Exclude []string
+	// Optional - regular expression the path relative to the repository must match
+	Pattern string
+	// Optional - takes the snapshot time from the file name, e.g. db-%Y%m%d-%H%M.sql.gz,
+	// instead of the modification time. Files not matching it are ignored.
+	TimeLayout string `mapstructure:"time_layout"`
+	// Optional - groups of files exported as repositories of their own
+	Groups []FileGroup
+	// Reads the latest archive to the end to check it is not corrupted,
+	// supports tar, tar.gz, tar.zst, zip and single gz or zst files
+	Verify bool
+	// Checks the latest archive against its .sha256 or .md5 sidecar,
+	// or its entry in a SHA256SUMS or MD5SUMS manifest
+	Checksum bool
+	// Optional - maximum bytes read per second while hashing, unlimited when zero.
+	// It also bounds the verification, which shares the read of the archive.
+	ChecksumRate int64 `mapstructure:"checksum_rate"`
+
+	collector.RepositoryOptions `mapstructure:",squash"`
+}
+
+// Represents a group of files of the repository, exported as a repository
+// named after the alias and the group, e.g. dumps/db. Its settings override
+// the ones of the repository when set.
+type FileGroup struct {
+	// The group name
+	Name string
+	// Optional - the extension of the files of the group
+	Extension string
+	// Optional - globs the files must match, any of them
+	Include []string
+	// Optional - globs the files must not match
+	Exclude []string
+	// Optional - regular expression the path relative to the repository must match
+	Pattern string
+	// Optional - takes the snapshot time from the file name
+	TimeLayout string `mapstructure:"time_layout"`
+}
+
+// Represents a tarball repository holding groups of files, each one
+// exported as a repository of its own
+type TarballGroup struct {
+	*TarballRepo
+}
+
+// Returns a repository for each group of files
+func (g *TarballGroup) Members(ctx context.Context) ([]collector.ContextBackupRepository, error) {
+	var members []collector.ContextBackupRepository
+	for _, group := range g.Groups {
+		member := *g.TarballRepo
+		member.Alias = g.Alias + "/" + group.Name
+		member.Groups = nil
+		if group.Extension != "" {
+			member.Extension = group.Extension
+		}
+		if group.Include != nil {
+			member.Include = group.Include
+		}
+		if group.Exclude != nil {
+			member.Exclude = group.Exclude
+		}
+		if group.Pattern != "" {
+			member.Pattern = group.Pattern
+		}
+		if group.TimeLayout != "" {
+			member.TimeLayout = group.TimeLayout
+		}
+		members = append(members, &member)
+	}
+	return members, nil
+}
+
+// Selects the files of the repository and tells their snapshot time
+type fileFilter struct {
+	extension        string
+	include, exclude []string
+	pattern          *regexp.Regexp
+	layout           *timeLayout
+	// Whether the checksum files are skipped
+	skipChecksums bool
+}
+
+func (t *TarballRepo) newFileFilter() (*fileFilter, error) {
+	filter := &fileFilter{
+		extension: addDotToFileExtension(t.Extension),
+		include:   t.Include,
+		exclude:   t.Exclude,
+		// Sidecars would otherwise be taken for snapshots
+		skipChecksums: t.Checksum,
+	}
+
+	for _, glob := range append(append([]string{}, t.Include...), t.Exclude...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %s", glob, err.Error())
+		}
+	}
+
+	var err error
+	if t.Pattern != "" {
+		filter.pattern, err = regexp.Compile(t.Pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.TimeLayout != "" {
+		filter.layout, err = compileTimeLayout(t.TimeLayout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+func matchesGlobs(globs []string, relativePath string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, relativePath); ok {
+			return true
+		}
+		if ok, _ := path.Match(glob, path.Base(relativePath)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the snapshot time of the file, false when the file is not selected
+func (f *fileFilter) snapshotTime(relativePath string, file os.FileInfo) (time.Time, bool) {
+	if !strings.HasSuffix(file.Name(), f.extension) {
+		return time.Time{}, false
+	}
+	if f.skipChecksums && isChecksumFile(file.Name()) {
+		return time.Time{}, false
+	}
+	if len(f.include) > 0 && !matchesGlobs(f.include, relativePath) {
+		return time.Time{}, false
+	}
+	if matchesGlobs(f.exclude, relativePath) {
+		return time.Time{}, false
+	}
+	if f.pattern != nil && !f.pattern.MatchString(relativePath) {
+		return time.Time{}, false
+	}
+	if f.layout != nil {
+		return f.layout.parse(file.Name())
+	}
+	return file.ModTime(), true
 }
 
 func addDotToFileExtension(fileExtension string) string {
@@ -41,29 +199,127 @@ func (t *TarballRepo) AliasName() string {
 	return t.Alias
 }
 
+// Returns the repository type
+func (t *TarballRepo) TypeName() string {
+	return "tarball"
+}
+
 // Retrieves informations about the latest snapshot of the Tarball repository
-func (t *TarballRepo) LatestSnapshot() (*collector.BackupSnapshot, error) {
+func (t *TarballRepo) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := t.Report(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return report.Latest, nil
+}
+
+// Retrieves the latest snapshot, all the snapshots and the size of the
+// Tarball repository from a single scan of its directory
+func (t *TarballRepo) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+	snapshots, err := t.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snapshots) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	latest := snapshots[0]
+	latestPath := filepath.Join(t.Path, filepath.FromSlash(latest.Name))
+	if t.Verify || t.Checksum {
+		latest.Metrics = archiveMetrics(t.Alias, latestPath, t.Verify, t.Checksum, t.ChecksumRate)
+	}
+
+	size := snapshotsSize(snapshots)
+	return &collector.RepositoryReport{Latest: latest, Snapshots: snapshots, Size: &size}, nil
+}
+
+// Retrieves informations about all the snapshots of the Tarball repository,
+// newest first
+func (t *TarballRepo) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
 
 	log.Println("Retrieving snapshot informations from path - ", t.Path)
 
-	files, err := ioutil.ReadDir(t.Path)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	filter, err := t.newFileFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	type snapshotFile struct {
+		relativePath string
+		date         time.Time
+		size         int64
+	}
+
+	// Walk does not follow a symbolic link given as the root
+	root, err := filepath.EvalSymlinks(t.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []snapshotFile
+	err = filepath.Walk(root, func(filePath string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if file.IsDir() {
+			if filePath != root && !t.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if date, ok := filter.snapshotTime(relativePath, file); ok {
+			files = append(files, snapshotFile{relativePath, date, file.Size()})
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	sort.Slice(files, func(i, j int) bool {
-		return files[i].ModTime().After(files[j].ModTime())
+		return files[i].date.After(files[j].date)
 	})
 
-	fileExtension := addDotToFileExtension(t.Extension)
+	var snapshots []*collector.BackupSnapshot
 	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), fileExtension) {
-			return &collector.BackupSnapshot{
-				Name:       file.Name(),
-				DateString: file.ModTime().UTC().Format(time.UnixDate),
-				Size:       float64(file.Size()),
-			}, nil
-		}
+		snapshots = append(snapshots, &collector.BackupSnapshot{
+			Name:       file.relativePath,
+			DateString: file.date.UTC().Format(time.UnixDate),
+			Size:       float64(file.size),
+		})
+	}
+	return snapshots, nil
+}
+
+// Retrieves the size of all the snapshots of the Tarball repository
+func (t *TarballRepo) RepositorySize(ctx context.Context) (float64, error) {
+	snapshots, err := t.Snapshots(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return snapshotsSize(snapshots), nil
+}
+
+func snapshotsSize(snapshots []*collector.BackupSnapshot) float64 {
+	var size float64
+	for _, snapshot := range snapshots {
+		size += snapshot.Size
 	}
-	return nil, collector.ErrSnapshotNotFound
+	return size
 }
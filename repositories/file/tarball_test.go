@@ -1,10 +1,12 @@
 package file
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -58,7 +60,7 @@ func TestLatestSnapshot(t *testing.T) {
 
 	repo := OpenRepository("testDir", dirPath, ".tar.gz")
 
-	tarballSnapshot, tarError := repo.LatestSnapshot()
+	tarballSnapshot, tarError := repo.LatestSnapshot(context.Background())
 
 	if tarError != nil {
 		t.Errorf("Unexpected error: %s", tarError.Error())
@@ -81,7 +83,7 @@ func TestLatestSnapshot(t *testing.T) {
 func TestLatestSnapshotUnknowFile(t *testing.T) {
 	t.Log("Testing an unknow file ")
 	repo := OpenRepository("testRepo", "unknow_directory_test_tarball", "tar.gz")
-	_, err := repo.LatestSnapshot()
+	_, err := repo.LatestSnapshot(context.Background())
 	if err == nil {
 		t.Fatalf("Expected an error")
 	}
@@ -93,8 +95,197 @@ func TestLatestSnapshotUnknowExtension(t *testing.T) {
 	defer tearDownTest(t)
 	repo := OpenRepository("testRepo", dirPath, "*.noext")
 
-	_, tarError := repo.LatestSnapshot()
+	_, tarError := repo.LatestSnapshot(context.Background())
 	if tarError == nil {
 		t.Fatalf("Expected error")
 	}
 }
+
+func TestLatestSnapshotCancelled(t *testing.T) {
+	t.Log("Testing a cancelled context ")
+	setupTest(t)
+	defer tearDownTest(t)
+	repo := OpenRepository("testRepo", dirPath, ".tar.gz")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, tarError := repo.LatestSnapshot(ctx)
+	if tarError != context.Canceled {
+		t.Fatalf("Expected %v but got %v", context.Canceled, tarError)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	t.Log("Testing the listing of all the snapshots ")
+	setupTest(t)
+	defer tearDownTest(t)
+
+	olderPath := filepath.Join(dirPath, "older_"+fileName)
+	if err := ioutil.WriteFile(olderPath, []byte("backup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	older := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(olderPath, older, older); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := OpenRepository("testRepo", dirPath, ".tar.gz")
+	snapshots, tarError := repo.Snapshots(context.Background())
+	if tarError != nil {
+		t.Fatalf("Unexpected error: %s", tarError.Error())
+	}
+
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected 2 snapshots but got %d", len(snapshots))
+	}
+	if snapshots[0].Name != fileName || snapshots[1].Name != "older_"+fileName {
+		t.Errorf("Expected the newest snapshot first but got %s, %s", snapshots[0].Name, snapshots[1].Name)
+	}
+
+	size, tarError := repo.RepositorySize(context.Background())
+	if tarError != nil {
+		t.Fatalf("Unexpected error: %s", tarError.Error())
+	}
+	if size != float64(len("backup")) {
+		t.Errorf("Size - Expected %d but got %f", len("backup"), size)
+	}
+
+	report, tarError := repo.Report(context.Background())
+	if tarError != nil {
+		t.Fatalf("Unexpected error: %s", tarError.Error())
+	}
+	if report.Latest.Name != fileName || len(report.Snapshots) != 2 || report.Size == nil || *report.Size != size {
+		t.Errorf("Expected the report to match the listing but got %v", report)
+	}
+}
+
+// Creates the files in a new directory, the files are given by relative path
+func setupTree(t *testing.T, files map[string]time.Time) string {
+	dir, err := ioutil.TempDir("", "tarball")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, modTime := range files {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filePath, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func snapshotNames(t *testing.T, repo *TarballRepo) []string {
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	var names []string
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	return names
+}
+
+func TestSnapshotsRecursive(t *testing.T) {
+	t.Log("Testing the recursive scanning with include and exclude globs")
+	now := time.Now()
+	dir := setupTree(t, map[string]time.Time{
+		"db-20180912-0100.sql.gz":       now,
+		"daily/db-20180913-0100.sql.gz": now.Add(-time.Hour),
+		"daily/files.tar.gz":            now.Add(-2 * time.Hour),
+		"tmp/db-20180914-0100.sql.gz":   now.Add(-3 * time.Hour),
+	})
+	defer os.RemoveAll(dir)
+
+	repo := OpenRepository("testRepo", dir, "")
+	if names := snapshotNames(t, repo); len(names) != 1 || names[0] != "db-20180912-0100.sql.gz" {
+		t.Errorf("Expected the top level file only but got %v", names)
+	}
+
+	repo.Recursive = true
+	repo.Include = []string{"db-*.sql.gz"}
+	repo.Exclude = []string{"tmp/*"}
+	expected := "db-20180912-0100.sql.gz daily/db-20180913-0100.sql.gz"
+	if names := strings.Join(snapshotNames(t, repo), " "); names != expected {
+		t.Errorf("Expected %s but got %s", expected, names)
+	}
+
+	repo.Exclude = nil
+	repo.Pattern = `^(daily|tmp)/`
+	expected = "daily/db-20180913-0100.sql.gz tmp/db-20180914-0100.sql.gz"
+	if names := strings.Join(snapshotNames(t, repo), " "); names != expected {
+		t.Errorf("Expected %s but got %s", expected, names)
+	}
+}
+
+func TestSnapshotsTimeLayout(t *testing.T) {
+	t.Log("Testing the snapshot time taken from the file name")
+	now := time.Now()
+	dir := setupTree(t, map[string]time.Time{
+		"db-20180912-0100.sql.gz": now,
+		"db-20180914-0230.sql.gz": now.Add(-time.Hour),
+		"db-latest.sql.gz":        now,
+		"files-20180913.tar.gz":   now,
+		"db-20181399-0100.sql.gz": now,
+	})
+	defer os.RemoveAll(dir)
+
+	repo := OpenRepository("testRepo", dir, "")
+	repo.TimeLayout = "db-%Y%m%d-%H%M.sql.gz"
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := time.Date(2018, 9, 14, 2, 30, 0, 0, time.Local).UTC().Format(time.UnixDate)
+	if snapshot.Name != "db-20180914-0230.sql.gz" || snapshot.DateString != expected {
+		t.Errorf("Expected db-20180914-0230.sql.gz at %s but got %s at %s", expected, snapshot.Name, snapshot.DateString)
+	}
+	if names := snapshotNames(t, repo); len(names) != 2 {
+		t.Errorf("Expected the files matching the layout only but got %v", names)
+	}
+
+	repo.TimeLayout = "db-%Q.sql.gz"
+	if _, err := repo.LatestSnapshot(context.Background()); err == nil {
+		t.Errorf("Expected an error for an unknown directive")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	t.Log("Testing the groups of files exported as repositories of their own")
+	now := time.Now()
+	dir := setupTree(t, map[string]time.Time{
+		"db-20180912-0100.sql.gz": now,
+		"files-20180913.tar.gz":   now,
+	})
+	defer os.RemoveAll(dir)
+
+	repo := OpenRepository("dumps", dir, ".tar.gz")
+	repo.Groups = []FileGroup{
+		{Name: "db", Extension: ".sql.gz", Include: []string{"db-*"}, TimeLayout: "db-%Y%m%d-%H%M.sql.gz"},
+		{Name: "files", TimeLayout: "files-%Y%m%d.tar.gz"},
+	}
+	members, err := (&TarballGroup{repo}).Members(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(members) != 2 || members[0].AliasName() != "dumps/db" || members[1].AliasName() != "dumps/files" {
+		t.Fatalf("Expected the members dumps/db and dumps/files but got %v", members)
+	}
+
+	for i, expected := range []string{"db-20180912-0100.sql.gz", "files-20180913.tar.gz"} {
+		snapshot, err := members[i].LatestSnapshot(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if snapshot.Name != expected {
+			t.Errorf("Expected %s but got %s", expected, snapshot.Name)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package kopia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var execCommand = exec.CommandContext
+
+// Represents the informations about the Kopia repository
+// used to retrieve informations about the snapshots of a source
+type KopiaRepository struct {
+	// The repository alias
+	Alias,
+	// The snapshot source, e.g. user@host:/path
+	Source,
+	// Optional kopia config file of the connected repository
+	ConfigFile,
+	// The required password to open the kopia repository
+	Password string
+
+	collector.RepositoryOptions `mapstructure:",squash"`
+}
+
+type kopiaSnapshot struct {
+	Id     string `json:"id"`
+	Source struct {
+		Host     string `json:"host"`
+		UserName string `json:"userName"`
+		Path     string `json:"path"`
+	} `json:"source"`
+	StartTime        time.Time `json:"startTime"`
+	IncompleteReason string    `json:"incompleteReason"`
+	Stats            struct {
+		TotalSize  float64 `json:"totalSize"`
+		ErrorCount float64 `json:"errorCount"`
+	} `json:"stats"`
+	// The user tags of the snapshot, keyed by "tag:" and the tag name
+	Tags map[string]string `json:"tags"`
+}
+
+func OpenRepository(alias, source, password string) *KopiaRepository {
+	return &KopiaRepository{
+		Alias:    alias,
+		Source:   source,
+		Password: password,
+	}
+}
+
+func (k *KopiaRepository) environmentVariables() []string {
+	env := append(os.Environ(), "KOPIA_PASSWORD="+k.Password)
+	if k.ConfigFile != "" {
+		env = append(env, "KOPIA_CONFIG_PATH="+k.ConfigFile)
+	}
+	return env
+}
+
+// Lists the complete snapshots of the source, oldest first
+func (k *KopiaRepository) listSnapshots(ctx context.Context) ([]kopiaSnapshot, error) {
+	cmd := execCommand(ctx, "kopia", "snapshot", "list", "--json", k.Source)
+	cmd.Env = k.environmentVariables()
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			log.Printf("kopia process output: %s", exitErr.Stderr)
+			if bytes.Contains(exitErr.Stderr, []byte("invalid repository password")) {
+				return nil, collector.ErrAuthentication
+			}
+		}
+		return nil, err
+	}
+
+	var manifests []kopiaSnapshot
+	err = json.Unmarshal(out, &manifests)
+	if err != nil {
+		return nil, &collector.ParseError{Err: err}
+	}
+
+	var snapshots []kopiaSnapshot
+	for _, snapshot := range manifests {
+		if snapshot.IncompleteReason == "" {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+// Returns the user tags of the snapshot as name:value, sorted
+func (snapshot *kopiaSnapshot) tags() []string {
+	var tags []string
+	for key, value := range snapshot.Tags {
+		if strings.HasPrefix(key, "tag:") {
+			tags = append(tags, strings.TrimPrefix(key, "tag:")+":"+value)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (snapshot *kopiaSnapshot) backupSnapshot() *collector.BackupSnapshot {
+	return &collector.BackupSnapshot{
+		Name:       snapshot.Id,
+		DateString: snapshot.StartTime.UTC().Format(time.UnixDate),
+		Size:       snapshot.Stats.TotalSize,
+		Tags:       snapshot.tags(),
+		Host:       snapshot.Source.Host,
+		Paths:      []string{snapshot.Source.Path},
+	}
+}
+
+// Returns an error when no source is configured, kopia would list the
+// snapshots of every source instead
+func (k *KopiaRepository) Validate() error {
+	if k.Source == "" {
+		return errors.New("the kopia source is required")
+	}
+	return nil
+}
+
+// Returns the alias of the Kopia repository
+func (k *KopiaRepository) AliasName() string {
+	return k.Alias
+}
+
+// Returns the repository type
+func (k *KopiaRepository) TypeName() string {
+	return "kopia"
+}
+
+// Retrieves informations about the latest snapshot of the source
+func (k *KopiaRepository) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := k.Report(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return report.Latest, nil
+}
+
+// Retrieves the latest snapshot and all the snapshots of the source from
+// a single kopia snapshot list run
+func (k *KopiaRepository) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+	snapshots, err := k.listSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snapshots) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	latest := snapshots[0]
+	for _, snapshot := range snapshots[1:] {
+		if snapshot.StartTime.After(latest.StartTime) {
+			latest = snapshot
+		}
+	}
+
+	backupSnapshot := latest.backupSnapshot()
+	backupSnapshot.Metrics = []collector.Metric{{
+		Name:  "backup_last_snapshot_errors",
+		Help:  "The number of errors encountered by the latest snapshot, Kopia and Velero only",
+		Value: latest.Stats.ErrorCount,
+	}}
+	return &collector.RepositoryReport{Latest: backupSnapshot, Snapshots: backupSnapshots(snapshots)}, nil
+}
+
+func backupSnapshots(kopiaSnapshots []kopiaSnapshot) []*collector.BackupSnapshot {
+	var snapshots []*collector.BackupSnapshot
+	for _, snapshot := range kopiaSnapshots {
+		snapshots = append(snapshots, snapshot.backupSnapshot())
+	}
+	return snapshots
+}
+
+// Retrieves informations about all the snapshots of the source
+func (k *KopiaRepository) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+	kopiaSnapshots, err := k.listSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return backupSnapshots(kopiaSnapshots), nil
+}
@@ -0,0 +1,187 @@
+package kopia
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var snapshotsJson = []byte(`[
+  {
+    "id": "6e1c7d2e1b5b2b3c6a1f2a8d0c4e2b1a",
+    "source": { "host": "myhost", "userName": "backup", "path": "/var/lib/data" },
+    "description": "",
+    "startTime": "2018-09-11T12:17:07.286761313Z",
+    "endTime": "2018-09-11T12:18:07.286761313Z",
+    "stats": { "totalSize": 1024, "errorCount": 0, "fileCount": 10 },
+    "retentionReason": [ "daily-2" ]
+  },
+  {
+    "id": "f2b7a9c1d3e5f7a9b1c3d5e7f9a1b3c5",
+    "source": { "host": "myhost", "userName": "backup", "path": "/var/lib/data" },
+    "description": "",
+    "startTime": "2018-09-12T12:17:07.286761313Z",
+    "endTime": "2018-09-12T12:18:32.229110942Z",
+    "stats": { "totalSize": 1371, "errorCount": 3, "fileCount": 12 },
+    "tags": { "tag:env": "prod", "tag:app": "db" },
+    "retentionReason": [ "latest-1", "daily-1" ]
+  },
+  {
+    "id": "0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d",
+    "source": { "host": "myhost", "userName": "backup", "path": "/var/lib/data" },
+    "startTime": "2018-09-13T12:17:07.286761313Z",
+    "incompleteReason": "checkpoint",
+    "stats": { "totalSize": 10 }
+  }
+]`)
+
+// The number of kopia runs started by the test
+var execCount int
+
+func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	execCount++
+	cs := []string{"-test.run=TestHelperProcess", "--", command}
+	cs = append(cs, args...)
+	return exec.CommandContext(ctx, os.Args[0], cs...)
+}
+
+// Returns the kopia arguments when running as a fake kopia process, nil otherwise
+func helperArgs() []string {
+	for idx, arg := range os.Args {
+		if arg == "--" && idx+1 < len(os.Args) && os.Args[idx+1] == "kopia" {
+			return os.Args[idx+2:]
+		}
+	}
+	return nil
+}
+
+func TestHelperProcess(t *testing.T) {
+	args := helperArgs()
+	if args == nil {
+		return
+	}
+
+	if os.Getenv("KOPIA_PASSWORD") == "wrong" {
+		fmt.Fprintf(os.Stderr, "ERROR error connecting to repository: invalid repository password")
+		os.Exit(1)
+	}
+
+	cmdArgs := strings.Join(args, " ")
+	switch cmdArgs {
+	case "snapshot list --json backup@myhost:/var/lib/data":
+		fmt.Fprintf(os.Stdout, "%s", snapshotsJson)
+	case "snapshot list --json backup@myhost:/empty":
+		fmt.Fprintf(os.Stdout, "[]")
+	default:
+		fmt.Fprintf(os.Stderr, "unexpected arguments %s", cmdArgs)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func setupTest(source, password string) (*KopiaRepository, func()) {
+	execCommand = fakeExecCommand
+	repo := OpenRepository("testRepo", source, password)
+	return repo, func() {
+		execCommand = exec.CommandContext
+	}
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	repo, teardown := setupTest("backup@myhost:/var/lib/data", "myPassword")
+	defer teardown()
+
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if snapshot.Name != "f2b7a9c1d3e5f7a9b1c3d5e7f9a1b3c5" {
+		t.Errorf("Name - Expected %s but got %s", "f2b7a9c1d3e5f7a9b1c3d5e7f9a1b3c5", snapshot.Name)
+	}
+
+	if snapshot.DateString != "Wed Sep 12 12:17:07 UTC 2018" {
+		t.Errorf("Date - Expected %s but got %s", "Wed Sep 12 12:17:07 UTC 2018", snapshot.DateString)
+	}
+
+	if snapshot.Size != 1371 {
+		t.Errorf("Size - Expected %f but got %f", float64(1371), snapshot.Size)
+	}
+
+	if len(snapshot.Metrics) != 1 || snapshot.Metrics[0].Value != 3 {
+		t.Errorf("Errors - Expected 3 but got %v", snapshot.Metrics)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	repo, teardown := setupTest("backup@myhost:/var/lib/data", "myPassword")
+	defer teardown()
+
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected the 2 complete snapshots but got %d", len(snapshots))
+	}
+
+	if len(snapshots[0].Tags) != 0 {
+		t.Errorf("Tags - Expected none but got %v", snapshots[0].Tags)
+	}
+	if strings.Join(snapshots[1].Tags, ",") != "app:db,env:prod" {
+		t.Errorf("Tags - Expected %s but got %v", "app:db,env:prod", snapshots[1].Tags)
+	}
+}
+
+func TestReport(t *testing.T) {
+	repo, teardown := setupTest("backup@myhost:/var/lib/data", "myPassword")
+	defer teardown()
+
+	execCount = 0
+	report, err := repo.Report(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if execCount != 1 {
+		t.Errorf("Expected kopia to run once but got %d runs", execCount)
+	}
+	if report.Latest.Name != "f2b7a9c1d3e5f7a9b1c3d5e7f9a1b3c5" || len(report.Snapshots) != 2 {
+		t.Errorf("Expected the latest snapshot and the 2 complete snapshots but got %v and %v", report.Latest, report.Snapshots)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := OpenRepository("testRepo", "", "myPassword").Validate(); err == nil {
+		t.Errorf("Expected an error without source")
+	}
+	if err := OpenRepository("testRepo", "backup@myhost:/var/lib/data", "myPassword").Validate(); err != nil {
+		t.Errorf("Unexpected error - '%s'", err.Error())
+	}
+}
+
+func TestLatestSnapshotEmptySource(t *testing.T) {
+	repo, teardown := setupTest("backup@myhost:/empty", "myPassword")
+	defer teardown()
+
+	_, err := repo.LatestSnapshot(context.Background())
+	if err != collector.ErrSnapshotNotFound {
+		t.Errorf("Expected %v but got %v", collector.ErrSnapshotNotFound, err)
+	}
+}
+
+func TestLatestSnapshotWrongPassword(t *testing.T) {
+	repo, teardown := setupTest("backup@myhost:/var/lib/data", "wrong")
+	defer teardown()
+
+	_, err := repo.LatestSnapshot(context.Background())
+	if err != collector.ErrAuthentication {
+		t.Errorf("Expected %v but got %v", collector.ErrAuthentication, err)
+	}
+}
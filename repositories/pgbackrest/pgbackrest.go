@@ -0,0 +1,283 @@
+package pgbackrest
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var execCommand = exec.CommandContext
+
+// Types of the pgBackRest backups, each one reported on its own
+var backupTypes = []string{"full", "diff", "incr"}
+
+// Represents the informations about the pgBackRest stanza
+// used to retrieve informations about its backups
+type PgBackRestRepository struct {
+	// The repository alias
+	Alias,
+	// The stanza of the PostgreSQL cluster
+	Stanza,
+	// Optional pgbackrest config file, e.g. /etc/pgbackrest/pgbackrest.conf
+	ConfigFile string
+	// Optional index of the pgbackrest repository, all of them when zero
+	Repo int
+
+	collector.RepositoryOptions `mapstructure:",squash"`
+}
+
+type pgBackRestBackup struct {
+	Label     string `json:"label"`
+	Type      string `json:"type"`
+	Timestamp struct {
+		Start int64 `json:"start"`
+		Stop  int64 `json:"stop"`
+	} `json:"timestamp"`
+	Info struct {
+		Size       float64 `json:"size"`
+		Repository struct {
+			Size  float64 `json:"size"`
+			Delta float64 `json:"delta"`
+		} `json:"repository"`
+	} `json:"info"`
+}
+
+type pgBackRestArchive struct {
+	Id  string `json:"id"`
+	Min string `json:"min"`
+	Max string `json:"max"`
+}
+
+type pgBackRestStanza struct {
+	Name    string              `json:"name"`
+	Backup  []pgBackRestBackup  `json:"backup"`
+	Archive []pgBackRestArchive `json:"archive"`
+	Status  struct {
+		Code    float64 `json:"code"`
+		Message string  `json:"message"`
+	} `json:"status"`
+}
+
+func OpenRepository(alias, stanza string) *PgBackRestRepository {
+	return &PgBackRestRepository{
+		Alias:  alias,
+		Stanza: stanza,
+	}
+}
+
+func (p *PgBackRestRepository) infoArgs() []string {
+	args := []string{"--stanza=" + p.Stanza}
+	if p.ConfigFile != "" {
+		args = append(args, "--config="+p.ConfigFile)
+	}
+	if p.Repo > 0 {
+		args = append(args, "--repo="+strconv.Itoa(p.Repo))
+	}
+	return append(args, "info", "--output=json")
+}
+
+// Runs pgbackrest info and returns the configured stanza
+func (p *PgBackRestRepository) info(ctx context.Context) (*pgBackRestStanza, error) {
+	cmd := execCommand(ctx, "pgbackrest", p.infoArgs()...)
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			log.Printf("pgbackrest process output: %s", exitErr.Stderr)
+		}
+		return nil, err
+	}
+
+	var stanzas []pgBackRestStanza
+	err = json.Unmarshal(out, &stanzas)
+	if err != nil {
+		return nil, &collector.ParseError{Err: err}
+	}
+
+	for idx := range stanzas {
+		if stanzas[idx].Name == p.Stanza {
+			return &stanzas[idx], nil
+		}
+	}
+	return nil, collector.ErrSnapshotNotFound
+}
+
+func (backup *pgBackRestBackup) backupSnapshot() *collector.BackupSnapshot {
+	return &collector.BackupSnapshot{
+		Name:       backup.Label,
+		DateString: time.Unix(backup.Timestamp.Start, 0).UTC().Format(time.UnixDate),
+		Size:       backup.Info.Repository.Size,
+		Tags:       []string{backup.Type},
+	}
+}
+
+// Returns the backups of the stanza, oldest first
+func (stanza *pgBackRestStanza) backups() []pgBackRestBackup {
+	backups := append([]pgBackRestBackup(nil), stanza.Backup...)
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Timestamp.Start < backups[j].Timestamp.Start
+	})
+	return backups
+}
+
+// Returns the number of a WAL segment name, e.g. 000000010000000A000000FF,
+// growing with the position in the WAL regardless of the timeline
+func walSegmentNumber(name string) (float64, bool) {
+	if len(name) != 24 {
+		return 0, false
+	}
+	logId, err := strconv.ParseUint(name[8:16], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	segment, err := strconv.ParseUint(name[16:24], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return float64(logId<<32 | segment), true
+}
+
+// Returns the metrics about the backup types, the WAL archive and the stanza
+func (stanza *pgBackRestStanza) metrics(backups []pgBackRestBackup) []collector.Metric {
+	metrics := []collector.Metric{{
+		Name:  "backup_stanza_status",
+		Help:  "The status code of the stanza, 0 when ok, pgBackRest only",
+		Value: stanza.Status.Code,
+	}}
+
+	latest := make(map[string]pgBackRestBackup)
+	for _, backup := range backups {
+		latest[backup.Type] = backup
+	}
+	for _, backupType := range backupTypes {
+		backup, ok := latest[backupType]
+		if !ok {
+			continue
+		}
+		labels := map[string]string{"type": backupType}
+		metrics = append(metrics,
+			collector.Metric{
+				Name:   "backup_last_snapshot_by_type_timestamp_seconds",
+				Help:   "The start time of the latest backup of the type as a Unix timestamp, pgBackRest only",
+				Labels: labels,
+				Value:  float64(backup.Timestamp.Start),
+			},
+			collector.Metric{
+				Name:   "backup_last_snapshot_by_type_size_bytes",
+				Help:   "The size of the database in the latest backup of the type, pgBackRest only",
+				Labels: labels,
+				Value:  backup.Info.Size,
+			},
+			collector.Metric{
+				Name:   "backup_last_snapshot_by_type_stored_bytes",
+				Help:   "The space used in the repository by the latest backup of the type, pgBackRest only",
+				Labels: labels,
+				Value:  backup.Info.Repository.Delta,
+			},
+		)
+	}
+
+	for _, archive := range stanza.Archive {
+		labels := map[string]string{"archive_id": archive.Id}
+		if min, ok := walSegmentNumber(archive.Min); ok {
+			metrics = append(metrics, collector.Metric{
+				Name:   "backup_wal_archive_min_segment",
+				Help:   "The position of the oldest WAL segment of the archive, pgBackRest only",
+				Labels: labels,
+				Value:  min,
+			})
+		}
+		if max, ok := walSegmentNumber(archive.Max); ok {
+			metrics = append(metrics, collector.Metric{
+				Name:   "backup_wal_archive_max_segment",
+				Help:   "The position of the newest WAL segment of the archive, pgBackRest only",
+				Labels: labels,
+				Value:  max,
+			})
+		}
+	}
+	return metrics
+}
+
+// Returns the alias of the pgBackRest repository
+func (p *PgBackRestRepository) AliasName() string {
+	return p.Alias
+}
+
+// Returns the repository type
+func (p *PgBackRestRepository) TypeName() string {
+	return "pgbackrest"
+}
+
+// Retrieves informations about the latest backup of the stanza, whatever its type
+func (p *PgBackRestRepository) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := p.Report(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return report.Latest, nil
+}
+
+// Retrieves the latest backup, all the backups and the space they use
+// from a single run of pgbackrest info
+func (p *PgBackRestRepository) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+	stanza, err := p.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := stanza.backups()
+	if len(backups) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	latest := backups[len(backups)-1].backupSnapshot()
+	latest.Metrics = stanza.metrics(backups)
+	size := stanza.size()
+	return &collector.RepositoryReport{
+		Latest:    latest,
+		Snapshots: backupSnapshots(backups),
+		Size:      &size,
+	}, nil
+}
+
+func backupSnapshots(backups []pgBackRestBackup) []*collector.BackupSnapshot {
+	var snapshots []*collector.BackupSnapshot
+	for _, backup := range backups {
+		snapshots = append(snapshots, backup.backupSnapshot())
+	}
+	return snapshots
+}
+
+// Retrieves informations about all the backups of the stanza
+func (p *PgBackRestRepository) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+	stanza, err := p.info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return backupSnapshots(stanza.backups()), nil
+}
+
+// Retrieves the space used by the backups of the stanza in the repository,
+// the WAL archive is left out as pgbackrest info does not report it
+func (p *PgBackRestRepository) RepositorySize(ctx context.Context) (float64, error) {
+	stanza, err := p.info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return stanza.size(), nil
+}
+
+// Returns the space used by the backups of the stanza in the repository
+func (stanza *pgBackRestStanza) size() float64 {
+	var size float64
+	for _, backup := range stanza.Backup {
+		size += backup.Info.Repository.Delta
+	}
+	return size
+}
@@ -0,0 +1,261 @@
+package pgbackrest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var infoJson = []byte(`[
+  {
+    "archive": [
+      {
+        "database": { "id": 1, "repo-key": 1 },
+        "id": "12-1",
+        "max": "00000001000000000000000C",
+        "min": "000000010000000000000002"
+      }
+    ],
+    "backup": [
+      {
+        "archive": { "start": "000000010000000000000002", "stop": "000000010000000000000002" },
+        "database": { "id": 1, "repo-key": 1 },
+        "info": { "delta": 25000000, "repository": { "delta": 3000000, "size": 3000000 }, "size": 25000000 },
+        "label": "20180911-091707F",
+        "prior": null,
+        "reference": null,
+        "timestamp": { "start": 1536657427, "stop": 1536657487 },
+        "type": "full"
+      },
+      {
+        "archive": { "start": "000000010000000000000008", "stop": "000000010000000000000008" },
+        "database": { "id": 1, "repo-key": 1 },
+        "info": { "delta": 2000000, "repository": { "delta": 200000, "size": 3100000 }, "size": 26000000 },
+        "label": "20180911-091707F_20180912-091707I",
+        "prior": "20180911-091707F",
+        "reference": [ "20180911-091707F" ],
+        "timestamp": { "start": 1536743827, "stop": 1536743852 },
+        "type": "incr"
+      },
+      {
+        "archive": { "start": "000000010000000000000005", "stop": "000000010000000000000005" },
+        "database": { "id": 1, "repo-key": 1 },
+        "info": { "delta": 1000000, "repository": { "delta": 100000, "size": 3050000 }, "size": 25500000 },
+        "label": "20180911-091707F_20180911-211707D",
+        "prior": "20180911-091707F",
+        "reference": [ "20180911-091707F" ],
+        "timestamp": { "start": 1536700627, "stop": 1536700647 },
+        "type": "diff"
+      }
+    ],
+    "cipher": "none",
+    "db": [ { "id": 1, "repo-key": 1, "system-id": 6970977677138971135, "version": "12" } ],
+    "name": "main",
+    "status": { "code": 0, "lock": { "backup": { "held": false } }, "message": "ok" }
+  }
+]`)
+
+var emptyInfoJson = []byte(`[
+  {
+    "archive": [],
+    "backup": [],
+    "cipher": "none",
+    "db": [],
+    "name": "empty",
+    "status": { "code": 2, "message": "no valid backups" }
+  }
+]`)
+
+func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	cs := []string{"-test.run=TestHelperProcess", "--", command}
+	cs = append(cs, args...)
+	return exec.CommandContext(ctx, os.Args[0], cs...)
+}
+
+// Returns the pgbackrest arguments when running as a fake pgbackrest process, nil otherwise
+func helperArgs() []string {
+	for idx, arg := range os.Args {
+		if arg == "--" && idx+1 < len(os.Args) && os.Args[idx+1] == "pgbackrest" {
+			return os.Args[idx+2:]
+		}
+	}
+	return nil
+}
+
+func TestHelperProcess(t *testing.T) {
+	args := helperArgs()
+	if args == nil {
+		return
+	}
+
+	cmdArgs := strings.Join(args, " ")
+	switch cmdArgs {
+	case "--stanza=main --config=/etc/pgbackrest/pgbackrest.conf info --output=json":
+		fmt.Fprintf(os.Stdout, "%s", infoJson)
+	case "--stanza=empty info --output=json":
+		fmt.Fprintf(os.Stdout, "%s", emptyInfoJson)
+	default:
+		fmt.Fprintf(os.Stderr, "unexpected arguments %s", cmdArgs)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func setupTest(stanza string) (*PgBackRestRepository, func()) {
+	execCommand = fakeExecCommand
+	repo := OpenRepository("testRepo", stanza)
+	if stanza == "main" {
+		repo.ConfigFile = "/etc/pgbackrest/pgbackrest.conf"
+	}
+	return repo, func() {
+		execCommand = exec.CommandContext
+	}
+}
+
+// Returns the value of the metric with the given name and labels
+func metricValue(metrics []collector.Metric, name string, labels map[string]string) (float64, bool) {
+	for _, metric := range metrics {
+		if metric.Name != name || len(metric.Labels) != len(labels) {
+			continue
+		}
+		matches := true
+		for key, value := range labels {
+			if metric.Labels[key] != value {
+				matches = false
+			}
+		}
+		if matches {
+			return metric.Value, true
+		}
+	}
+	return 0, false
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	repo, teardown := setupTest("main")
+	defer teardown()
+
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if snapshot.Name != "20180911-091707F_20180912-091707I" {
+		t.Errorf("Name - Expected %s but got %s", "20180911-091707F_20180912-091707I", snapshot.Name)
+	}
+
+	if snapshot.Size != 3100000 {
+		t.Errorf("Size - Expected %f but got %f", float64(3100000), snapshot.Size)
+	}
+
+	expected := time.Unix(1536743827, 0).UTC().Format(time.UnixDate)
+	if snapshot.DateString != expected {
+		t.Errorf("Date - Expected %s but got %s", expected, snapshot.DateString)
+	}
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected float64
+	}{
+		{"backup_stanza_status", nil, 0},
+		{"backup_last_snapshot_by_type_timestamp_seconds", map[string]string{"type": "full"}, 1536657427},
+		{"backup_last_snapshot_by_type_timestamp_seconds", map[string]string{"type": "diff"}, 1536700627},
+		{"backup_last_snapshot_by_type_timestamp_seconds", map[string]string{"type": "incr"}, 1536743827},
+		{"backup_last_snapshot_by_type_size_bytes", map[string]string{"type": "full"}, 25000000},
+		{"backup_last_snapshot_by_type_stored_bytes", map[string]string{"type": "diff"}, 100000},
+		{"backup_wal_archive_min_segment", map[string]string{"archive_id": "12-1"}, 2},
+		{"backup_wal_archive_max_segment", map[string]string{"archive_id": "12-1"}, 12},
+	}
+	for _, test := range tests {
+		value, ok := metricValue(snapshot.Metrics, test.name, test.labels)
+		if !ok {
+			t.Errorf("%s%v - Expected a metric", test.name, test.labels)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("%s%v - Expected %f but got %f", test.name, test.labels, test.expected, value)
+		}
+	}
+	for _, metric := range snapshot.Metrics {
+		// The segment names would create a new series whenever WAL is archived
+		if _, ok := metric.Labels["max"]; ok {
+			t.Errorf("%s - Expected no WAL segment name label", metric.Name)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	repo, teardown := setupTest("main")
+	defer teardown()
+
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if len(snapshots) != 3 {
+		t.Fatalf("Expected 3 snapshots but got %d", len(snapshots))
+	}
+
+	if snapshots[1].Name != "20180911-091707F_20180911-211707D" {
+		t.Errorf("Expected the backups oldest first but got %s", snapshots[1].Name)
+	}
+
+	size, err := repo.RepositorySize(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if size != 3300000 {
+		t.Errorf("Size - Expected %f but got %f", float64(3300000), size)
+	}
+}
+
+func TestReport(t *testing.T) {
+	repo, teardown := setupTest("main")
+	defer teardown()
+
+	report, err := repo.Report(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if report.Latest.Name != report.Snapshots[len(report.Snapshots)-1].Name {
+		t.Errorf("Expected the latest backup to be the newest one but got %s", report.Latest.Name)
+	}
+
+	if len(report.Snapshots) != 3 {
+		t.Errorf("Expected 3 snapshots but got %d", len(report.Snapshots))
+	}
+
+	if report.Size == nil || *report.Size != 3300000 {
+		t.Errorf("Size - Expected %f but got %v", float64(3300000), report.Size)
+	}
+}
+
+func TestLatestSnapshotNoBackup(t *testing.T) {
+	repo, teardown := setupTest("empty")
+	defer teardown()
+
+	_, err := repo.LatestSnapshot(context.Background())
+	if err != collector.ErrSnapshotNotFound {
+		t.Errorf("Expected %v but got %v", collector.ErrSnapshotNotFound, err)
+	}
+}
+
+func TestWalSegmentNumber(t *testing.T) {
+	value, ok := walSegmentNumber("000000020000000A000000FF")
+	if !ok || value != float64(0xA<<32|0xFF) {
+		t.Errorf("Expected %f but got %f", float64(0xA<<32|0xFF), value)
+	}
+
+	if _, ok := walSegmentNumber("00000002.history"); ok {
+		t.Errorf("Expected an invalid segment name")
+	}
+}
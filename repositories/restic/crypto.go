@@ -0,0 +1,111 @@
+package restic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ivSize  = aes.BlockSize
+	macSize = poly1305.TagSize
+	// Space taken by the IV and the MAC around every encrypted content
+	cryptoOverhead = ivSize + macSize
+)
+
+var errInvalidMAC = errors.New("ciphertext verification failed")
+
+// Represents the keys used by restic to encrypt and authenticate contents:
+// AES-256 in counter mode and Poly1305-AES
+type cryptoKey struct {
+	MAC struct {
+		K []byte `json:"k"`
+		R []byte `json:"r"`
+	} `json:"mac"`
+	Encrypt []byte `json:"encrypt"`
+}
+
+// Represents a restic key file, the master key it holds is encrypted
+// with a key derived from the password
+type keyFile struct {
+	KDF  string `json:"kdf"`
+	N    int    `json:"N"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt []byte `json:"salt"`
+	Data []byte `json:"data"`
+}
+
+// Derives the user key from the password and decrypts the master key
+func (k *keyFile) masterKey(password string) (*cryptoKey, error) {
+	if k.KDF != "scrypt" {
+		return nil, errors.New("unsupported key derivation function " + k.KDF)
+	}
+
+	derived, err := scrypt.Key([]byte(password), k.Salt, k.N, k.R, k.P, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	userKey := &cryptoKey{Encrypt: derived[:32]}
+	userKey.MAC.K = derived[32:48]
+	userKey.MAC.R = derived[48:]
+
+	plaintext, err := userKey.decrypt(k.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	master := &cryptoKey{}
+	err = json.Unmarshal(plaintext, master)
+	if err != nil {
+		return nil, err
+	}
+	return master, nil
+}
+
+// Returns the Poly1305 key for the given nonce, the r part is clamped by poly1305 itself
+func (k *cryptoKey) poly1305Key(nonce []byte) (*[32]byte, error) {
+	block, err := aes.NewCipher(k.MAC.K)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	copy(key[:16], k.MAC.R)
+	block.Encrypt(key[16:], nonce)
+	return &key, nil
+}
+
+// Verifies and decrypts a content laid out as IV || ciphertext || MAC
+func (k *cryptoKey) decrypt(content []byte) ([]byte, error) {
+	if len(content) < cryptoOverhead {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	iv := content[:ivSize]
+	ciphertext := content[ivSize : len(content)-macSize]
+	var mac [macSize]byte
+	copy(mac[:], content[len(content)-macSize:])
+
+	macKey, err := k.poly1305Key(iv)
+	if err != nil {
+		return nil, err
+	}
+	if !poly1305.Verify(&mac, ciphertext, macKey) {
+		return nil, errInvalidMAC
+	}
+
+	block, err := aes.NewCipher(k.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+	return plaintext, nil
+}
@@ -0,0 +1,181 @@
+package restic
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+// Values of the group_by setting
+const (
+	GroupByHost      = "host"
+	GroupByPaths     = "paths"
+	GroupByHostPaths = "host,paths"
+)
+
+// Represents the host and paths shared by the snapshots of a group member
+type snapshotGroup struct {
+	host  string
+	paths []string
+}
+
+// Returns the tag lists the snapshots must match, as given to restic --tag.
+// The alias is the tag when no selector is configured, for compatibility.
+func (r *ResticRepository) tagLists() []string {
+	if len(r.Tags) == 0 && len(r.Hosts) == 0 && len(r.Paths) == 0 && r.GroupBy == "" && r.group == nil {
+		return []string{r.Alias}
+	}
+	return r.Tags
+}
+
+// Returns the arguments selecting the snapshots of the repository
+func (r *ResticRepository) selectorArgs() []string {
+	var args []string
+	for _, tags := range r.tagLists() {
+		args = append(args, "--tag", tags)
+	}
+	hosts := r.Hosts
+	if r.group != nil && r.group.host != "" {
+		hosts = []string{r.group.host}
+	}
+	for _, host := range hosts {
+		args = append(args, "--host", host)
+	}
+	paths := r.Paths
+	if r.group != nil && r.group.paths != nil {
+		paths = r.group.paths
+	}
+	for _, path := range paths {
+		args = append(args, "--path", path)
+	}
+	return args
+}
+
+// Returns whether the snapshot is selected: it must hold all the tags of
+// any of the tag lists, be taken from any of the hosts and hold all the paths.
+// Group members only select the snapshots of their exact host and paths.
+func (r *ResticRepository) matches(tags []string, host string, paths []string) bool {
+	if tagLists := r.tagLists(); len(tagLists) > 0 && !matchesTagLists(tagLists, tags) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !contains(r.Hosts, host) {
+		return false
+	}
+	for _, path := range r.Paths {
+		if !contains(paths, path) {
+			return false
+		}
+	}
+
+	if r.group != nil {
+		if r.GroupBy != GroupByPaths && r.group.host != host {
+			return false
+		}
+		if r.GroupBy != GroupByHost && groupPaths(paths) != groupPaths(r.group.paths) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesTagLists(tagLists []string, tags []string) bool {
+	for _, tagList := range tagLists {
+		matched := true
+		for _, tag := range strings.Split(tagList, ",") {
+			if !contains(tags, tag) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func groupPaths(paths []string) string {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// Returns the group of the snapshot and its alias suffix,
+// e.g. /host1, :/etc,/var or /host1:/etc,/var
+func (r *ResticRepository) groupOf(host string, paths []string) (*snapshotGroup, string) {
+	sorted := strings.Split(groupPaths(paths), ",")
+	switch r.GroupBy {
+	case GroupByHost:
+		return &snapshotGroup{host: host}, "/" + host
+	case GroupByPaths:
+		return &snapshotGroup{paths: sorted}, ":" + groupPaths(paths)
+	}
+	return &snapshotGroup{host: host, paths: sorted}, "/" + host + ":" + groupPaths(paths)
+}
+
+// Represents a restic repository shared by many hosts or paths, each group
+// of snapshots is exported as a repository of its own
+type ResticGroup struct {
+	*ResticRepository
+}
+
+// Returns a repository for each group of snapshots, named after the alias
+// and the group, e.g. shared/host1
+func (g *ResticGroup) Members(ctx context.Context) ([]collector.ContextBackupRepository, error) {
+	r := g.ResticRepository
+	switch r.GroupBy {
+	case GroupByHost, GroupByPaths, GroupByHostPaths:
+	default:
+		return nil, fmt.Errorf("unknown restic group_by %q", r.GroupBy)
+	}
+
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var aliases []string
+	groups := make(map[string]*snapshotGroup)
+	for _, snapshot := range snapshots {
+		group, name := r.groupOf(snapshot.Host, snapshot.Paths)
+		alias := r.Alias + name
+		if _, ok := groups[alias]; !ok {
+			aliases = append(aliases, alias)
+			groups[alias] = group
+		}
+	}
+	sort.Strings(aliases)
+
+	var ids []string
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.Name)
+	}
+	r.sizeState().prune(ids)
+
+	// Created before copying the repository so the members share them
+	r.healthState()
+	r.nativeState()
+
+	// The health is the one of the whole repository, only the first member reports it
+	var members []collector.ContextBackupRepository
+	for idx, alias := range aliases {
+		member := *r
+		member.Alias = alias
+		member.group = groups[alias]
+		member.skipHealth = idx > 0
+		members = append(members, &member)
+	}
+	return members, nil
+}
@@ -0,0 +1,197 @@
+package restic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+// Maximum time given to restic check and stats when not configured
+const DefaultHealthTimeout = time.Hour
+
+// Represents the settings of the repository health collection, which runs in
+// background on its own schedule as restic check may take hours
+type HealthOptions struct {
+	// Time between the restic check runs, disabled when zero
+	CheckInterval time.Duration `mapstructure:"check_interval"`
+	// Optional - portion of the data read by restic check, e.g. 10%
+	ReadDataSubset string `mapstructure:"read_data_subset"`
+	// Time between the repository stats runs, disabled when zero
+	StatsInterval time.Duration `mapstructure:"stats_interval"`
+	// Maximum time given to each run, defaults to DefaultHealthTimeout
+	Timeout time.Duration
+}
+
+// Holds the outcome of the latest health runs of a repository
+type repositoryHealth struct {
+	mutex                      sync.Mutex
+	checkRunning, statsRunning bool
+	checkStarted, statsStarted time.Time
+	check, stats               []collector.Metric
+	// The size of the data stored, from the latest stats run
+	repositorySize *float64
+}
+
+// Guards the lazy creation of the health of the repositories
+var healthMutex sync.Mutex
+
+func (r *ResticRepository) healthState() *repositoryHealth {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	if r.health == nil {
+		r.health = &repositoryHealth{}
+	}
+	return r.health
+}
+
+// Returns the metrics of the latest health runs and starts the runs that are due.
+// The results are reported by the refreshes following the end of the runs.
+func (r *ResticRepository) healthMetrics() []collector.Metric {
+	if r.skipHealth || r.Health.CheckInterval <= 0 && r.Health.StatsInterval <= 0 {
+		return nil
+	}
+
+	health := r.healthState()
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	now := time.Now()
+	if r.Health.CheckInterval > 0 && !health.checkRunning && now.Sub(health.checkStarted) >= r.Health.CheckInterval {
+		health.checkRunning = true
+		health.checkStarted = now
+		go r.runHealth(func(ctx context.Context) {
+			metrics := r.check(ctx)
+			health.mutex.Lock()
+			health.check, health.checkRunning = metrics, false
+			health.mutex.Unlock()
+		})
+	}
+	if r.Health.StatsInterval > 0 && !health.statsRunning && now.Sub(health.statsStarted) >= r.Health.StatsInterval {
+		health.statsRunning = true
+		health.statsStarted = now
+		go r.runHealth(func(ctx context.Context) {
+			metrics, size, err := r.stats(ctx)
+			if err != nil {
+				log.Printf("failed to collect the stats of %v: %s", r.Alias, err.Error())
+			}
+			health.mutex.Lock()
+			// The stats of the previous run are kept on failures
+			if err == nil {
+				health.stats = metrics
+				health.repositorySize = &size
+			}
+			health.statsRunning = false
+			health.mutex.Unlock()
+		})
+	}
+
+	return append(append([]collector.Metric{}, health.check...), health.stats...)
+}
+
+// Returns the size of the data stored in the repository, measured by the
+// latest stats run, nil when the stats never ran
+func (r *ResticRepository) healthRepositorySize() *float64 {
+	if r.Health.StatsInterval <= 0 {
+		return nil
+	}
+
+	health := r.healthState()
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+	return health.repositorySize
+}
+
+func (r *ResticRepository) runHealth(run func(ctx context.Context)) {
+	timeout := r.Health.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	run(ctx)
+}
+
+// Represents the summary printed by restic check with --json
+type checkSummary struct {
+	MessageType string  `json:"message_type"`
+	NumErrors   float64 `json:"num_errors"`
+}
+
+// Runs restic check and reports whether it passed and the errors it found
+func (r *ResticRepository) check(ctx context.Context) []collector.Metric {
+	args := []string{"check"}
+	if r.Health.ReadDataSubset != "" {
+		args = append(args, "--read-data-subset", r.Health.ReadDataSubset)
+	}
+	out, err := r.exec(ctx, args...)
+
+	success := 1.0
+	var errors float64
+	if err != nil {
+		log.Printf("restic check of %v failed: %s", r.Alias, err.Error())
+		success = 0
+		// Older restic versions print no summary, the failure counts as one error
+		errors = 1
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		var summary checkSummary
+		if json.Unmarshal(scanner.Bytes(), &summary) == nil && summary.MessageType == "summary" {
+			errors = summary.NumErrors
+		}
+	}
+
+	return []collector.Metric{
+		{Name: "backup_check_success", Help: "1 when the latest restic check passed, 0 otherwise", Value: success},
+		{Name: "backup_check_errors", Help: "The number of errors reported by the latest restic check", Value: errors},
+		{Name: "backup_check_timestamp_seconds", Help: "The end time of the latest restic check as a Unix timestamp", Value: float64(time.Now().Unix())},
+	}
+}
+
+// Runs restic stats and list to report the deduplication of the repository,
+// returns the size of the data stored along with the metrics
+func (r *ResticRepository) stats(ctx context.Context) ([]collector.Metric, float64, error) {
+	var restore, raw resticSnapshotStats
+	for mode, stats := range map[string]*resticSnapshotStats{"restore-size": &restore, "raw-data": &raw} {
+		out, err := r.exec(ctx, "stats", "--mode", mode)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(out, stats); err != nil {
+			return nil, 0, &collector.ParseError{Err: err}
+		}
+	}
+
+	out, err := r.exec(ctx, "list", "packs")
+	if err != nil {
+		return nil, 0, err
+	}
+	var packs float64
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			packs++
+		}
+	}
+
+	metrics := []collector.Metric{
+		{Name: "backup_restore_size_bytes", Help: "The size of the files of all the snapshots once restored", Value: restore.TotalSize},
+		{Name: "backup_blob_count", Help: "The number of unique blobs stored in the repository", Value: raw.TotalBlobCount},
+		{Name: "backup_pack_count", Help: "The number of pack files stored in the repository", Value: packs},
+	}
+	if raw.TotalSize > 0 {
+		metrics = append(metrics, collector.Metric{
+			Name: "backup_deduplication_ratio", Help: "The restore size of the snapshots divided by the size of the data stored",
+			Value: restore.TotalSize / raw.TotalSize,
+		})
+	}
+	return metrics, raw.TotalSize, nil
+}
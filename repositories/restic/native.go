@@ -0,0 +1,609 @@
+package restic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Versions of the restic repository format, the second one compresses contents
+const (
+	formatVersionUncompressed = 1
+	formatVersionCompressed   = 2
+)
+
+// Leading byte of the compressed files of the version 2 repositories,
+// uncompressed ones start with the JSON document itself
+const compressedFileMarker = 2
+
+// Represents a local restic repository read directly from its files, without
+// the restic binary. It never creates locks, like restic with --no-lock.
+type nativeRepository struct {
+	path  string
+	key   *cryptoKey
+	index map[string]indexedBlob
+}
+
+type repositoryConfig struct {
+	Version int    `json:"version"`
+	Id      string `json:"id"`
+}
+
+// Represents the location of a blob inside the pack files
+type indexedBlob struct {
+	pack               string
+	offset, length     int64
+	uncompressedLength int64
+}
+
+type indexFile struct {
+	Packs []struct {
+		Id    string `json:"id"`
+		Blobs []struct {
+			Id                 string `json:"id"`
+			Offset             int64  `json:"offset"`
+			Length             int64  `json:"length"`
+			UncompressedLength int64  `json:"uncompressed_length"`
+		} `json:"blobs"`
+	} `json:"packs"`
+}
+
+type nativeSnapshot struct {
+	Id       string
+	Time     time.Time `json:"time"`
+	Tree     string    `json:"tree"`
+	Paths    []string  `json:"paths"`
+	Hostname string    `json:"hostname"`
+	Tags     []string  `json:"tags"`
+}
+
+type tree struct {
+	Nodes []struct {
+		Content []string `json:"content"`
+		Subtree string   `json:"subtree"`
+	} `json:"nodes"`
+}
+
+// Holds what is costly to read from a native repository between the refreshes:
+// the master key derived with scrypt, the index and the size of the snapshots.
+// The key and the index are read again when their files change.
+type nativeCache struct {
+	mutex      sync.Mutex
+	repository *nativeRepository
+	password   string
+	// The names of the key and index files the repository was read from
+	keys, indexes string
+	// The size of all the snapshots and their ids, once computed
+	sized     bool
+	snapshots string
+	size      float64
+	// Whether the size is being computed in background
+	sizing bool
+}
+
+// Guards the lazy creation of the caches of the native repositories
+var nativeMutex sync.Mutex
+
+func (r *ResticRepository) nativeState() *nativeCache {
+	nativeMutex.Lock()
+	defer nativeMutex.Unlock()
+	if r.nativeCache == nil {
+		r.nativeCache = &nativeCache{}
+	}
+	return r.nativeCache
+}
+
+// Returns the names of the files of the directory, which are the hashes
+// of their content in a restic repository
+func fileNames(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return strings.Join(names, ","), nil
+}
+
+// Opens the repository with the first key the password decrypts and loads its index
+func openNativeRepository(ctx context.Context, path, password string) (*nativeRepository, error) {
+	n, err := unlockNativeRepository(ctx, path, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Opens the repository with the first key the password decrypts and reads its config
+func unlockNativeRepository(ctx context.Context, path, password string) (*nativeRepository, error) {
+	n := &nativeRepository{path: path}
+
+	keys, err := ioutil.ReadDir(filepath.Join(path, "keys"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(path, "keys", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		key := &keyFile{}
+		if err := json.Unmarshal(content, key); err != nil {
+			return nil, &collector.ParseError{Err: err}
+		}
+
+		master, err := key.masterKey(password)
+		if err == errInvalidMAC {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.key = master
+		break
+	}
+
+	if n.key == nil {
+		return nil, collector.ErrAuthentication
+	}
+
+	config := &repositoryConfig{}
+	if err := n.readJSON(filepath.Join(path, "config"), config); err != nil {
+		return nil, err
+	}
+	if config.Version != formatVersionUncompressed && config.Version != formatVersionCompressed {
+		return nil, fmt.Errorf("unsupported repository version %d", config.Version)
+	}
+	return n, nil
+}
+
+// Reads, decrypts and decompresses if needed, a file holding a single JSON document
+func (n *nativeRepository) readJSON(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := n.key.decrypt(content)
+	if err != nil {
+		return err
+	}
+
+	if len(plaintext) > 0 && plaintext[0] == compressedFileMarker {
+		plaintext, err = decompress(plaintext[1:])
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := json.Unmarshal(plaintext, v); err != nil {
+		return &collector.ParseError{Err: err}
+	}
+	return nil
+}
+
+func decompress(content []byte) ([]byte, error) {
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(content, nil)
+}
+
+func (n *nativeRepository) loadIndex(ctx context.Context) error {
+	n.index = make(map[string]indexedBlob)
+
+	files, err := ioutil.ReadDir(filepath.Join(n.path, "index"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		index := &indexFile{}
+		if err := n.readJSON(filepath.Join(n.path, "index", file.Name()), index); err != nil {
+			return err
+		}
+
+		for _, pack := range index.Packs {
+			for _, blob := range pack.Blobs {
+				n.index[blob.Id] = indexedBlob{
+					pack:               pack.Id,
+					offset:             blob.Offset,
+					length:             blob.Length,
+					uncompressedLength: blob.UncompressedLength,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns all the snapshots of the repository
+func (n *nativeRepository) snapshots(ctx context.Context) ([]*nativeSnapshot, error) {
+	files, err := ioutil.ReadDir(filepath.Join(n.path, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*nativeSnapshot
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		snapshot := &nativeSnapshot{Id: file.Name()}
+		if err := n.readJSON(filepath.Join(n.path, "snapshots", file.Name()), snapshot); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// Reads and decrypts a blob from its pack file
+func (n *nativeRepository) readBlob(id string) ([]byte, error) {
+	blob, ok := n.index[id]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found in the index", id)
+	}
+
+	if len(blob.pack) < 2 {
+		return nil, fmt.Errorf("invalid pack id %q", blob.pack)
+	}
+	pack, err := os.Open(filepath.Join(n.path, "data", blob.pack[:2], blob.pack))
+	if err != nil {
+		return nil, err
+	}
+	defer pack.Close()
+
+	content := make([]byte, blob.length)
+	if _, err := io.ReadFull(io.NewSectionReader(pack, blob.offset, blob.length), content); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := n.key.decrypt(content)
+	if err != nil {
+		return nil, err
+	}
+
+	if blob.uncompressedLength > 0 {
+		return decompress(plaintext)
+	}
+	return plaintext, nil
+}
+
+// Returns the size of the unique blobs referenced by the given trees,
+// as reported by restic stats --mode raw-data
+func (n *nativeRepository) rawDataSize(ctx context.Context, trees ...string) (float64, error) {
+	seen := make(map[string]bool)
+
+	var walk func(id string) error
+	walk = func(id string) error {
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		content, err := n.readBlob(id)
+		if err != nil {
+			return err
+		}
+
+		current := &tree{}
+		if err := json.Unmarshal(content, current); err != nil {
+			return &collector.ParseError{Err: err}
+		}
+
+		for _, node := range current.Nodes {
+			for _, blob := range node.Content {
+				seen[blob] = true
+			}
+			if node.Subtree != "" {
+				if err := walk(node.Subtree); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, id := range trees {
+		if err := walk(id); err != nil {
+			return 0, err
+		}
+	}
+
+	var size float64
+	for id := range seen {
+		blob, ok := n.index[id]
+		if !ok {
+			return 0, fmt.Errorf("blob %s not found in the index", id)
+		}
+		size += float64(blob.length)
+	}
+	return size, nil
+}
+
+func (snapshot *nativeSnapshot) shortId() string {
+	if len(snapshot.Id) < 8 {
+		return snapshot.Id
+	}
+	return snapshot.Id[:8]
+}
+
+func (snapshot *nativeSnapshot) backupSnapshot() *collector.BackupSnapshot {
+	return &collector.BackupSnapshot{
+		Name:       snapshot.shortId(),
+		DateString: snapshot.Time.UTC().Format(time.UnixDate),
+		Tags:       snapshot.Tags,
+		Host:       snapshot.Hostname,
+		Paths:      snapshot.Paths,
+	}
+}
+
+// Prefixes of the restic backends that are not local directories
+var remoteBackends = []string{"rest:", "sftp:", "s3:", "b2:", "azure:", "gs:", "swift:", "rclone:"}
+
+// Returns the password of the repository, read from the password file
+// or command when it is not given directly
+func (r *ResticRepository) password(ctx context.Context) (string, error) {
+	switch {
+	case r.Password != "":
+		return r.Password, nil
+	case r.PasswordFile != "":
+		content, err := ioutil.ReadFile(r.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	case r.PasswordCommand != "":
+		// Run by the shell so the arguments may be quoted
+		out, err := execCommand(ctx, "sh", "-c", r.PasswordCommand).Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return "", collector.ErrAuthentication
+}
+
+// Opens the repository, the key and the index of the previous opening are
+// reused as long as the password and the key and index files are unchanged
+func (r *ResticRepository) openNative(ctx context.Context) (*nativeRepository, error) {
+	for _, prefix := range remoteBackends {
+		if strings.HasPrefix(r.Path, prefix) {
+			return nil, fmt.Errorf("the native mode only reads local repositories, not %s", r.Path)
+		}
+	}
+
+	password, err := r.password(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	path := strings.TrimPrefix(r.Path, "local:")
+	keys, err := fileNames(filepath.Join(path, "keys"))
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := fileNames(filepath.Join(path, "index"))
+	if err != nil {
+		return nil, err
+	}
+
+	cache := r.nativeState()
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	n := cache.repository
+	switch {
+	case n == nil || cache.password != password || cache.keys != keys:
+		n, err = openNativeRepository(ctx, path, password)
+	case cache.indexes != indexes:
+		// The previous repository may still be read in background, it is left unchanged
+		n = &nativeRepository{path: n.path, key: n.key}
+		err = n.loadIndex(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cache.repository, cache.password, cache.keys, cache.indexes = n, password, keys, indexes
+	return n, nil
+}
+
+// Returns the snapshots matching the selectors of the repository
+func (r *ResticRepository) nativeSnapshots(ctx context.Context) (*nativeRepository, []*nativeSnapshot, error) {
+	n, err := r.openNative(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	all, err := n.snapshots(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n, r.selectNative(all), nil
+}
+
+// Returns the snapshots matching the selectors of the repository among the given ones
+func (r *ResticRepository) selectNative(all []*nativeSnapshot) []*nativeSnapshot {
+	var snapshots []*nativeSnapshot
+	for _, snapshot := range all {
+		if r.matches(snapshot.Tags, snapshot.Hostname, snapshot.Paths) {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots
+}
+
+// Retrieves the latest snapshot, all the selected snapshots and the size of
+// the repository from a single opening of the repository
+func (r *ResticRepository) nativeReport(ctx context.Context) (*collector.RepositoryReport, error) {
+	n, err := r.openNative(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := n.snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := r.selectNative(all)
+
+	if len(snapshots) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	latest := snapshots[0]
+	for _, snapshot := range snapshots[1:] {
+		if snapshot.Time.After(latest.Time) {
+			latest = snapshot
+		}
+	}
+
+	sizes := r.sizeState()
+	size, ok := sizes.get(latest.shortId())
+	if !ok {
+		size, err = n.rawDataSize(ctx, latest.Tree)
+		if err != nil {
+			return nil, err
+		}
+		sizes.set(latest.shortId(), size)
+	}
+
+	trees := make(map[string]string)
+	var ids []string
+	for _, snapshot := range snapshots {
+		trees[snapshot.shortId()] = snapshot.Tree
+		ids = append(ids, snapshot.shortId())
+	}
+	if r.group == nil {
+		sizes.prune(ids)
+	}
+	r.fillSizes(ids, func(ctx context.Context, id string) (float64, error) {
+		return n.rawDataSize(ctx, trees[id])
+	})
+
+	backupSnapshot := latest.backupSnapshot()
+	backupSnapshot.Size = size
+	return &collector.RepositoryReport{
+		Latest:    backupSnapshot,
+		Snapshots: r.nativeSizedSnapshots(snapshots),
+		Size:      r.nativeSize(n, all),
+	}, nil
+}
+
+// Returns the snapshots with the sizes known so far, the missing ones are left to 0
+func (r *ResticRepository) nativeSizedSnapshots(snapshots []*nativeSnapshot) []*collector.BackupSnapshot {
+	sizes := r.sizeState()
+	var backupSnapshots []*collector.BackupSnapshot
+	for _, snapshot := range snapshots {
+		backupSnapshot := snapshot.backupSnapshot()
+		backupSnapshot.Size, _ = sizes.get(backupSnapshot.Name)
+		backupSnapshots = append(backupSnapshots, backupSnapshot)
+	}
+	return backupSnapshots
+}
+
+func (r *ResticRepository) nativeSnapshotList(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+	_, snapshots, err := r.nativeSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.nativeSizedSnapshots(snapshots), nil
+}
+
+// Returns the size of the unique blobs referenced by all the snapshots, an
+// error until it is computed in background
+func (r *ResticRepository) nativeRepositorySize(ctx context.Context) (float64, error) {
+	n, err := r.openNative(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	snapshots, err := n.snapshots(ctx)
+	if err != nil {
+		return 0, err
+	}
+	size := r.nativeSize(n, snapshots)
+	if size == nil {
+		return 0, errRepositorySizePending
+	}
+	return *size, nil
+}
+
+// Returns the size of the unique blobs referenced by the given snapshots. The trees
+// are walked again in background when the snapshots change, as reading all of them
+// does not fit in the refreshes, and the previous size is reported until then.
+// Nil until the first computation ends.
+func (r *ResticRepository) nativeSize(n *nativeRepository, snapshots []*nativeSnapshot) *float64 {
+	var ids, trees []string
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.Id)
+		trees = append(trees, snapshot.Tree)
+	}
+	sort.Strings(ids)
+	listed := strings.Join(ids, ",")
+
+	cache := r.nativeState()
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if (!cache.sized || cache.snapshots != listed) && !cache.sizing {
+		cache.sizing = true
+		go r.runHealth(func(ctx context.Context) {
+			size, err := n.rawDataSize(ctx, trees...)
+			if err != nil {
+				log.Printf("failed to compute the size of %v: %s", r.Alias, err.Error())
+			}
+			cache.mutex.Lock()
+			defer cache.mutex.Unlock()
+			// The previous size is kept on failures, it is computed again on the next refresh
+			if err == nil {
+				cache.sized, cache.snapshots, cache.size = true, listed, size
+			}
+			cache.sizing = false
+		})
+	}
+
+	if !cache.sized {
+		return nil
+	}
+	size := cache.size
+	return &size
+}
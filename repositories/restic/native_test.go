@@ -0,0 +1,428 @@
+package restic
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const testPassword = "secret"
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func encrypt(t *testing.T, key *cryptoKey, plaintext []byte) []byte {
+	iv := randomBytes(t, ivSize)
+	block, err := aes.NewCipher(key.Encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, plaintext)
+
+	macKey, err := key.poly1305Key(iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mac [macSize]byte
+	poly1305.Sum(&mac, ciphertext, macKey)
+
+	content := append(iv, ciphertext...)
+	return append(content, mac[:]...)
+}
+
+func compress(t *testing.T, plaintext []byte) []byte {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(plaintext, nil)
+}
+
+func storageId(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func marshal(t *testing.T, v interface{}) []byte {
+	content, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// Writes the encrypted and compressed JSON document of a version 2 repository
+func writeCompressedJSON(t *testing.T, key *cryptoKey, dir string, v interface{}) {
+	plaintext := append([]byte{compressedFileMarker}, compress(t, marshal(t, v))...)
+	content := encrypt(t, key, plaintext)
+	writeFile(t, filepath.Join(dir, storageId(content)), content)
+}
+
+// Builds a version 2 repository holding two snapshots of the test1 tag sharing
+// a file, and one snapshot of another tag
+func newNativeRepository(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "restic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master := &cryptoKey{Encrypt: randomBytes(t, 32)}
+	master.MAC.K = randomBytes(t, 16)
+	master.MAC.R = randomBytes(t, 16)
+
+	key := &keyFile{KDF: "scrypt", N: 1024, R: 8, P: 1, Salt: randomBytes(t, 64)}
+	derived, err := scrypt.Key([]byte(testPassword), key.Salt, key.N, key.R, key.P, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKey := &cryptoKey{Encrypt: derived[:32]}
+	userKey.MAC.K = derived[32:48]
+	userKey.MAC.R = derived[48:]
+	key.Data = encrypt(t, userKey, marshal(t, master))
+	writeFile(t, filepath.Join(dir, "keys", "key"), marshal(t, key))
+
+	writeFile(t, filepath.Join(dir, "config"), encrypt(t, master, marshal(t, &repositoryConfig{Version: 2, Id: "test"})))
+
+	type blob struct {
+		Id                 string `json:"id"`
+		Type               string `json:"type"`
+		Offset             int64  `json:"offset"`
+		Length             int64  `json:"length"`
+		UncompressedLength int64  `json:"uncompressed_length,omitempty"`
+	}
+	var pack []byte
+	var blobs []blob
+	addBlob := func(kind string, plaintext []byte, compressed bool) string {
+		id := storageId(plaintext)
+		b := blob{Id: id, Type: kind, Offset: int64(len(pack))}
+		if compressed {
+			b.UncompressedLength = int64(len(plaintext))
+			plaintext = compress(t, plaintext)
+		}
+		content := encrypt(t, master, plaintext)
+		b.Length = int64(len(content))
+		pack = append(pack, content...)
+		blobs = append(blobs, b)
+		return id
+	}
+
+	type node struct {
+		Name    string   `json:"name"`
+		Type    string   `json:"type"`
+		Content []string `json:"content,omitempty"`
+		Subtree string   `json:"subtree,omitempty"`
+	}
+	nodes := func(n ...node) []byte {
+		return marshal(t, map[string][]node{"nodes": n})
+	}
+
+	shared := addBlob("data", []byte("shared file content"), false)
+	old := addBlob("data", []byte("old file content"), true)
+	latest := addBlob("data", []byte("latest file content, a bit longer"), false)
+	other := addBlob("data", []byte("other"), false)
+
+	oldSubtree := addBlob("tree", nodes(node{Name: "old", Type: "file", Content: []string{old}}), false)
+	oldTree := addBlob("tree", nodes(
+		node{Name: "shared", Type: "file", Content: []string{shared}},
+		node{Name: "dir", Type: "dir", Subtree: oldSubtree},
+	), false)
+	latestSubtree := addBlob("tree", nodes(node{Name: "latest", Type: "file", Content: []string{latest, shared}}), true)
+	latestTree := addBlob("tree", nodes(
+		node{Name: "shared", Type: "file", Content: []string{shared}},
+		node{Name: "dir", Type: "dir", Subtree: latestSubtree},
+	), false)
+	otherTree := addBlob("tree", nodes(node{Name: "other", Type: "file", Content: []string{other}}), false)
+
+	packId := storageId(pack)
+	writeFile(t, filepath.Join(dir, "data", packId[:2], packId), pack)
+
+	lengths := make(map[string]int64)
+	for _, b := range blobs {
+		lengths[b.Id] = b.Length
+	}
+	testLatestSize = lengths[shared] + lengths[latest] + lengths[latestTree] + lengths[latestSubtree]
+	testRepositorySize = testLatestSize + lengths[old] + lengths[oldTree] + lengths[oldSubtree] + lengths[other] + lengths[otherTree]
+
+	writeCompressedJSON(t, master, filepath.Join(dir, "index"), map[string]interface{}{
+		"packs": []map[string]interface{}{{"id": packId, "blobs": blobs}},
+	})
+
+	snapshots := []map[string]interface{}{
+		{"time": "2018-09-12T09:17:07.286761313-03:00", "tree": oldTree, "paths": []string{"/data"}, "hostname": "backup-host", "tags": []string{"test1"}},
+		{"time": "2018-09-13T09:17:07.286761313-03:00", "tree": latestTree, "paths": []string{"/data"}, "hostname": "backup-host", "tags": []string{"test1"}},
+		{"time": "2018-09-14T09:17:07.286761313-03:00", "tree": otherTree, "paths": []string{"/other"}, "hostname": "backup-host", "tags": []string{"test2"}},
+	}
+	for _, snapshot := range snapshots {
+		writeCompressedJSON(t, master, filepath.Join(dir, "snapshots"), snapshot)
+	}
+	return dir
+}
+
+var testLatestSize, testRepositorySize int64
+
+func TestNativeLatestSnapshot(t *testing.T) {
+	dir := newNativeRepository(t)
+	defer os.RemoveAll(dir)
+
+	repo := &ResticRepository{Alias: "test1", Path: dir, Password: testPassword, Mode: ModeNative}
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if snapshot.DateString != "Thu Sep 13 12:17:07 UTC 2018" {
+		t.Errorf("Expected the date of the latest snapshot but got %s", snapshot.DateString)
+	}
+	if len(snapshot.Name) != 8 {
+		t.Errorf("Expected a short id but got %s", snapshot.Name)
+	}
+	if snapshot.Size != float64(testLatestSize) {
+		t.Errorf("Expected size %d but got %v", testLatestSize, snapshot.Size)
+	}
+	if snapshot.Host != "backup-host" || len(snapshot.Paths) != 1 || snapshot.Paths[0] != "/data" {
+		t.Errorf("Expected the host and paths of the snapshot but got %s %v", snapshot.Host, snapshot.Paths)
+	}
+
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(snapshots) != 2 {
+		t.Errorf("Expected the 2 snapshots of the tag but got %d", len(snapshots))
+	}
+
+	// The size of the repository is computed in background
+	size, err := repo.RepositorySize(context.Background())
+	for i := 0; i < 100 && err == errRepositorySizePending; i++ {
+		time.Sleep(10 * time.Millisecond)
+		size, err = repo.RepositorySize(context.Background())
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if size != float64(testRepositorySize) {
+		t.Errorf("Expected repository size %d but got %v", testRepositorySize, size)
+	}
+}
+
+func TestNativeReport(t *testing.T) {
+	dir := newNativeRepository(t)
+	defer os.RemoveAll(dir)
+
+	repo := &ResticRepository{Alias: "test1", Path: dir, Password: testPassword, Mode: ModeNative}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		report, err := repo.Report(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if report.Size != nil && *report.Size != float64(testRepositorySize) {
+			t.Fatalf("Expected repository size %d but got %v", testRepositorySize, *report.Size)
+		}
+		if len(report.Snapshots) != 2 {
+			t.Fatalf("Expected the 2 snapshots of the tag but got %d", len(report.Snapshots))
+		}
+
+		// The sizes of the repository and of the older snapshot are computed in background
+		if report.Size != nil && report.Snapshots[0].Size > 0 && report.Snapshots[1].Size > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The sizes were not computed in background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNativeErrors(t *testing.T) {
+	dir := newNativeRepository(t)
+	defer os.RemoveAll(dir)
+
+	repo := &ResticRepository{Alias: "test1", Path: dir, Password: "wrong", Mode: ModeNative}
+	if _, err := repo.LatestSnapshot(context.Background()); err != collector.ErrAuthentication {
+		t.Errorf("Expected %v but got %v", collector.ErrAuthentication, err)
+	}
+
+	repo = &ResticRepository{Alias: "missing", Path: dir, Password: testPassword, Mode: ModeNative}
+	if _, err := repo.LatestSnapshot(context.Background()); err != collector.ErrSnapshotNotFound {
+		t.Errorf("Expected %v but got %v", collector.ErrSnapshotNotFound, err)
+	}
+
+	repo = &ResticRepository{Alias: "test1", Path: dir, Password: testPassword, Mode: "unknown"}
+	if _, err := repo.LatestSnapshot(context.Background()); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
+
+func TestNativePasswordFile(t *testing.T) {
+	dir := newNativeRepository(t)
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	writeFile(t, passwordFile, []byte(testPassword+"\n"))
+
+	repo := &ResticRepository{Alias: "test1", Path: "local:" + dir, PasswordFile: passwordFile, Mode: ModeNative}
+	if _, err := repo.LatestSnapshot(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	repo = &ResticRepository{Alias: "test1", Path: "sftp:user@host:/srv/restic", Password: testPassword, Mode: ModeNative}
+	if _, err := repo.LatestSnapshot(context.Background()); err == nil {
+		t.Errorf("Expected an error for a remote repository in the native mode")
+	}
+}
+
+func TestNativePasswordCommand(t *testing.T) {
+	dir := newNativeRepository(t)
+	defer os.RemoveAll(dir)
+
+	repo := &ResticRepository{Alias: "test1", Path: dir, PasswordCommand: `printf '%s' '` + testPassword + `'`, Mode: ModeNative}
+	if _, err := repo.LatestSnapshot(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+}
+
+func TestNativeCache(t *testing.T) {
+	dir := newNativeRepository(t)
+	defer os.RemoveAll(dir)
+
+	repo := &ResticRepository{Alias: "test1", Path: dir, Password: testPassword, Mode: ModeNative}
+	first, err := repo.openNative(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	second, err := repo.openNative(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if second != first {
+		t.Errorf("Expected the repository to be reused while its files are unchanged")
+	}
+
+	// A new index file is loaded without deriving the key again
+	indexes, err := ioutil.ReadDir(filepath.Join(dir, "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "index", indexes[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "index", "ff"+indexes[0].Name()[2:]), content)
+
+	third, err := repo.openNative(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if third == first || third.key != first.key {
+		t.Errorf("Expected the index to be loaded again with the same key")
+	}
+
+	repo.Password = "wrong"
+	if _, err := repo.openNative(context.Background()); err != collector.ErrAuthentication {
+		t.Errorf("Expected %v after a password change but got %v", collector.ErrAuthentication, err)
+	}
+}
+
+// Compares the native reading with restic itself on a repository created by
+// restic, so changes of the repository format are caught. Skipped when restic
+// is not installed.
+func TestNativeMatchesRestic(t *testing.T) {
+	restic, err := exec.LookPath("restic")
+	if err != nil {
+		t.Skip("restic is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "restic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repoDir, dataDir := filepath.Join(dir, "repo"), filepath.Join(dir, "data")
+
+	run := func(args ...string) []byte {
+		cmd := exec.Command(restic, args...)
+		cmd.Env = append(os.Environ(), "RESTIC_REPOSITORY="+repoDir, "RESTIC_PASSWORD="+testPassword)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("restic %v failed: %s", args, err.Error())
+		}
+		return out
+	}
+
+	run("init")
+	writeFile(t, filepath.Join(dataDir, "first"), randomBytes(t, 64*1024))
+	run("backup", "--tag", "test1", "--host", "backup-host", dataDir)
+	writeFile(t, filepath.Join(dataDir, "nested", "second"), randomBytes(t, 16*1024))
+	run("backup", "--tag", "test1", "--host", "backup-host", dataDir)
+
+	var snapshots []resticSnapshot
+	if err := json.Unmarshal(run("snapshots", "--json"), &snapshots); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := latestSnapshot(snapshots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var latestStats, repositoryStats resticSnapshotStats
+	if err := json.Unmarshal(run("stats", "--json", "--mode", "raw-data", latest.Id), &latestStats); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(run("stats", "--json", "--mode", "raw-data"), &repositoryStats); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &ResticRepository{Alias: "test1", Path: repoDir, Password: testPassword, Mode: ModeNative}
+	report, err := repo.Report(context.Background())
+	for i := 0; i < 100 && err == nil && report.Size == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		report, err = repo.Report(context.Background())
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if report.Latest.Name != latest.Id || len(report.Snapshots) != 2 {
+		t.Errorf("Expected the latest snapshot %s of 2 but got %s of %d", latest.Id, report.Latest.Name, len(report.Snapshots))
+	}
+	if report.Latest.DateString != latest.creationDateString() {
+		t.Errorf("Expected the date %s but got %s", latest.creationDateString(), report.Latest.DateString)
+	}
+	if report.Latest.Size != latestStats.TotalSize {
+		t.Errorf("Expected the snapshot size %v but got %v", latestStats.TotalSize, report.Latest.Size)
+	}
+	if report.Size == nil || *report.Size != repositoryStats.TotalSize {
+		t.Errorf("Expected the repository size %v but got %v", repositoryStats.TotalSize, report.Size)
+	}
+}
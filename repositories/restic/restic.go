@@ -1,7 +1,10 @@
 package restic
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -11,22 +14,93 @@ import (
 	"github.com/ddtmachado/prom-backup-exporter/collector"
 )
 
-var execCommand = exec.Command
+var execCommand = exec.CommandContext
+
+// Returned for the size of the repository until the health stats run
+var errRepositorySizeUnknown = errors.New("the repository size is collected by the health stats, set health.stats_interval")
+
+// Returned by the native mode until the size of the repository is computed in background
+var errRepositorySizePending = errors.New("the repository size is not computed yet")
+
+// Modes of reading the restic repository
+const (
+	ModeExec   = "exec"
+	ModeNative = "native"
+)
 
 // Represents the informations about the restic respository
 // used to retrieve informations about the snapshots
 type ResticRepository struct {
-	// The repository alias - used as the restic backup tag
+	// The repository alias - used as the restic backup tag when no selector is set
 	Alias,
-	// The path to the repository
+	// The location of the repository, a local path or any restic backend
+	// e.g. rest:https://host:8000/, sftp:user@host:/srv/restic or s3:s3.amazonaws.com/bucket
 	Path,
 	// The required password to open the restic repository
-	Password string
+	Password,
+	// How the repository is read: "exec" runs the restic binary (default),
+	// "native" reads the files of a local repository directly
+	Mode string
+
+	// Optional - file holding the password, instead of the password itself
+	PasswordFile string `mapstructure:"password_file"`
+	// Optional - command printing the password, instead of the password itself
+	PasswordCommand string `mapstructure:"password_command"`
+
+	// Optional - credentials of the REST server backend
+	RestUsername string `mapstructure:"rest_username"`
+	RestPassword string `mapstructure:"rest_password"`
+	// Optional - command used to connect to the SFTP backend
+	SFTPCommand string `mapstructure:"sftp_command"`
+	// Optional - credentials of the S3 backend
+	AWSAccessKeyId     string `mapstructure:"aws_access_key_id"`
+	AWSSecretAccessKey string `mapstructure:"aws_secret_access_key"`
+	AWSSessionToken    string `mapstructure:"aws_session_token"`
+	AWSRegion          string `mapstructure:"aws_region"`
+
+	// Optional - directory of the restic cache
+	CacheDir string `mapstructure:"cache_dir"`
+	// Do not lock the repository, so it can be read while a backup or prune runs
+	NoLock bool `mapstructure:"no_lock"`
+	// Optional - extra flags given to every restic command
+	Flags []string
+	// Optional - extra environment variables given to every restic command, as NAME=value.
+	// A list rather than a table as the configuration keys are not case sensitive.
+	Env []string
+
+	// Optional - tag lists selecting the snapshots, as given to restic --tag:
+	// a snapshot must hold all the comma separated tags of any of the lists
+	Tags []string
+	// Optional - hosts the snapshots must be taken from, any of them
+	Hosts []string
+	// Optional - paths the snapshots must hold, all of them
+	Paths []string
+	// Optional - exports each group of snapshots as a repository of its own:
+	// "host", "paths" or "host,paths"
+	GroupBy string `mapstructure:"group_by"`
+
+	// Optional - repository health collected on its own schedule
+	Health HealthOptions
+
+	// The host and paths of the snapshots when the repository is a group member
+	group *snapshotGroup
+	// The outcome of the health runs, shared by the group members
+	health *repositoryHealth
+	// Whether the health is reported by another group member, so the
+	// metrics of the repository are only exported once
+	skipHealth bool
+	// The sizes of the snapshots, shared by the group members
+	sizes *snapshotSizes
+	// The key and index of the native mode, shared by the group members
+	nativeCache *nativeCache
+
+	collector.RepositoryOptions `mapstructure:",squash"`
 }
 
 type resticSnapshot struct {
 	Time        string
 	Tags, Paths []string
+	Hostname    string
 	Id          string `json:"short_id"`
 }
 
@@ -35,46 +109,107 @@ type resticSnapshotStats struct {
 	TotalBlobCount float64 `json:"total_blob_count"`
 }
 
-func (r *ResticRepository) open() error {
-	cmd := execCommand("restic", "check")
-	cmd.Env = r.environmentVariables()
-	_, err := cmd.Output()
-	return err
+func (r *ResticRepository) environmentVariables() []string {
+	env := append(os.Environ(), "RESTIC_REPOSITORY="+r.Path)
+
+	optional := []struct{ name, value string }{
+		{"RESTIC_PASSWORD", r.Password},
+		{"RESTIC_PASSWORD_FILE", r.PasswordFile},
+		{"RESTIC_PASSWORD_COMMAND", r.PasswordCommand},
+		{"RESTIC_REST_USERNAME", r.RestUsername},
+		{"RESTIC_REST_PASSWORD", r.RestPassword},
+		{"AWS_ACCESS_KEY_ID", r.AWSAccessKeyId},
+		{"AWS_SECRET_ACCESS_KEY", r.AWSSecretAccessKey},
+		{"AWS_SESSION_TOKEN", r.AWSSessionToken},
+		{"AWS_DEFAULT_REGION", r.AWSRegion},
+	}
+	for _, variable := range optional {
+		if variable.value != "" {
+			env = append(env, variable.name+"="+variable.value)
+		}
+	}
+	return append(env, r.Env...)
 }
 
-func (r *ResticRepository) environmentVariables() []string {
-	return append(os.Environ(),
-		"RESTIC_PASSWORD="+r.Password,
-		"RESTIC_REPOSITORY="+r.Path,
-	)
+// Returns the global flags given to every restic command
+func (r *ResticRepository) globalFlags() []string {
+	flags := []string{"--json"}
+	if r.NoLock {
+		flags = append(flags, "--no-lock")
+	}
+	if r.CacheDir != "" {
+		flags = append(flags, "--cache-dir", r.CacheDir)
+	}
+	if r.SFTPCommand != "" {
+		flags = append(flags, "--option", "sftp.command="+r.SFTPCommand)
+	}
+	return append(flags, r.Flags...)
 }
 
-func (r *ResticRepository) exec(args ...string) ([]byte, error) {
-	cmd := execCommand("restic", append(args, "--json")...)
+func (r *ResticRepository) exec(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := execCommand(ctx, "restic", append(args, r.globalFlags()...)...)
 	cmd.Env = r.environmentVariables()
 	out, err := cmd.CombinedOutput()
 	log.Printf("restic process output: %s", out)
+	if err != nil && bytes.Contains(out, []byte("wrong password")) {
+		return out, collector.ErrAuthentication
+	}
 	return out, err
 }
 
-func (r *ResticRepository) latestSnapshotForTag() (*resticSnapshot, error) {
-	var snapshot []resticSnapshot
-	out, err := r.exec("snapshots", "--last", "--tag", r.Alias)
+// Returns the snapshots matching the selectors of the repository
+func (r *ResticRepository) selectedSnapshots(ctx context.Context) ([]resticSnapshot, error) {
+	out, err := r.exec(ctx, append([]string{"snapshots"}, r.selectorArgs()...)...)
 	if err != nil {
-		log.Println(err)
-		return &resticSnapshot{}, err
+		return nil, err
 	}
 
-	err = json.Unmarshal(out, &snapshot)
+	var snapshots []resticSnapshot
+	err = json.Unmarshal(out, &snapshots)
 	if err != nil {
-		fmt.Println("error:", err)
 		return nil, err
 	}
 
-	if len(snapshot) == 0 {
-		return &resticSnapshot{}, collector.ErrSnapshotNotFound
+	var selected []resticSnapshot
+	for _, snapshot := range snapshots {
+		if r.matches(snapshot.Tags, snapshot.Hostname, snapshot.Paths) {
+			selected = append(selected, snapshot)
+		}
 	}
-	return &snapshot[0], nil
+	return selected, nil
+}
+
+func (r *ResticRepository) latestSelectedSnapshot(ctx context.Context) (*resticSnapshot, error) {
+	snapshots, err := r.selectedSnapshots(ctx)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return latestSnapshot(snapshots)
+}
+
+// Returns the newest of the snapshots
+func latestSnapshot(snapshots []resticSnapshot) (*resticSnapshot, error) {
+	if len(snapshots) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	latest := &snapshots[0]
+	for i := range snapshots[1:] {
+		snapshot := &snapshots[i+1]
+		if snapshot.creationDate().After(latest.creationDate()) {
+			latest = snapshot
+		}
+	}
+	return latest, nil
+}
+
+func (snapshot *resticSnapshot) creationDate() time.Time {
+	creationDate, err := time.Parse(time.RFC3339, snapshot.Time)
+	if err != nil {
+		log.Println(err)
+	}
+	return creationDate
 }
 
 func (snapshot *resticSnapshot) creationDateString() string {
@@ -86,20 +221,48 @@ func (snapshot *resticSnapshot) creationDateString() string {
 	return creationDate.UTC().Format(time.UnixDate)
 }
 
-func (r *ResticRepository) snapshotSize(snapshot *resticSnapshot) float64 {
-	out, err := r.exec("stats", snapshot.Id, "--mode", "raw-data")
+// Returns the size of the data only referenced by the snapshot
+func (r *ResticRepository) snapshotSize(ctx context.Context, id string) (float64, error) {
+	out, err := r.exec(ctx, "stats", id, "--mode", "raw-data")
 	if err != nil {
-		log.Println(err)
-		return 0
+		return 0, err
 	}
 
 	var snapshotStat resticSnapshotStats
-	err = json.Unmarshal(out, &snapshotStat)
-	if err != nil {
-		fmt.Println("error:", err)
+	if err := json.Unmarshal(out, &snapshotStat); err != nil {
+		return 0, &collector.ParseError{Err: err}
 	}
+	return snapshotStat.TotalSize, nil
+}
 
-	return snapshotStat.TotalSize
+func (snapshot *resticSnapshot) backupSnapshot() *collector.BackupSnapshot {
+	return &collector.BackupSnapshot{
+		Name:       snapshot.Id,
+		DateString: snapshot.creationDateString(),
+		Tags:       snapshot.Tags,
+		Host:       snapshot.Hostname,
+		Paths:      snapshot.Paths,
+	}
+}
+
+// Returns the snapshots with the sizes known so far, the missing ones are left to 0
+func (r *ResticRepository) sizedSnapshots(resticSnapshots []resticSnapshot) []*collector.BackupSnapshot {
+	sizes := r.sizeState()
+	var snapshots []*collector.BackupSnapshot
+	for i := range resticSnapshots {
+		snapshot := resticSnapshots[i].backupSnapshot()
+		snapshot.Size, _ = sizes.get(snapshot.Name)
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+func snapshotIds(snapshots []resticSnapshot) []string {
+	var ids []string
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.Id)
+	}
+	return ids
 }
 
 // Returns the backup tag name
@@ -107,15 +270,109 @@ func (r *ResticRepository) AliasName() string {
 	return r.Alias
 }
 
+// Returns the repository type
+func (r *ResticRepository) TypeName() string {
+	return "restic"
+}
+
+// Returns whether the repository is read natively, an unknown mode is an error
+func (r *ResticRepository) native() (bool, error) {
+	switch r.Mode {
+	case "", ModeExec:
+		return false, nil
+	case ModeNative:
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown restic mode %q", r.Mode)
+}
+
 // Retrieves informations about the latest snapshot of the Restic repository
-func (r *ResticRepository) LatestSnapshot() (*collector.BackupSnapshot, error) {
-	resticSnapshot, err := r.latestSnapshotForTag()
+func (r *ResticRepository) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := r.Report(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &collector.BackupSnapshot{
-		Name:       resticSnapshot.Id,
-		DateString: resticSnapshot.creationDateString(),
-		Size:       r.snapshotSize(resticSnapshot),
+	return report.Latest, nil
+}
+
+// Retrieves the latest snapshot and all the selected snapshots from a single
+// listing. The sizes of the older snapshots are computed in background and
+// reported once known, the size of the repository comes from the health stats.
+func (r *ResticRepository) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+	if native, err := r.native(); err != nil || native {
+		if err != nil {
+			return nil, err
+		}
+		return r.nativeReport(ctx)
+	}
+
+	resticSnapshots, err := r.selectedSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	latest, err := latestSnapshot(resticSnapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	// A snapshot without size would be taken as a shrunken backup
+	sizes := r.sizeState()
+	size, ok := sizes.get(latest.Id)
+	if !ok {
+		size, err = r.snapshotSize(ctx, latest.Id)
+		if err != nil {
+			return nil, err
+		}
+		sizes.set(latest.Id, size)
+	}
+
+	ids := snapshotIds(resticSnapshots)
+	if r.group == nil {
+		sizes.prune(ids)
+	}
+	r.fillSizes(ids, r.snapshotSize)
+
+	backupSnapshot := latest.backupSnapshot()
+	backupSnapshot.Size = size
+	backupSnapshot.Metrics = r.healthMetrics()
+	return &collector.RepositoryReport{
+		Latest:    backupSnapshot,
+		Snapshots: r.sizedSnapshots(resticSnapshots),
+		Size:      r.healthRepositorySize(),
 	}, nil
 }
+
+// Retrieves informations about all the selected snapshots, their size is
+// reported once computed in background
+func (r *ResticRepository) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+	if native, err := r.native(); err != nil || native {
+		if err != nil {
+			return nil, err
+		}
+		return r.nativeSnapshotList(ctx)
+	}
+
+	resticSnapshots, err := r.selectedSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.sizedSnapshots(resticSnapshots), nil
+}
+
+// Retrieves the size of the deduplicated data stored in the restic repository,
+// taken from the latest health stats run as restic stats reads the whole repository
+func (r *ResticRepository) RepositorySize(ctx context.Context) (float64, error) {
+	if native, err := r.native(); err != nil || native {
+		if err != nil {
+			return 0, err
+		}
+		return r.nativeRepositorySize(ctx)
+	}
+
+	size := r.healthRepositorySize()
+	if size == nil {
+		return 0, errRepositorySizeUnknown
+	}
+	return *size, nil
+}
@@ -1,6 +1,7 @@
 package restic
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"os/exec"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ddtmachado/prom-backup-exporter/collector"
 )
@@ -21,16 +23,25 @@ var test1Json = []byte(`{
 var test2Json = []byte(`{
 	"time": "2018-09-12T09:18:32.229110942-03:00",
   "tags":[ "test2" ],
+  "hostname": "backup-host",
+  "paths": [ "/var/lib/data" ],
   "short_id": "f8da39e9"
 }`)
 
-func fakeExecCommand(command string, args ...string) *exec.Cmd {
+var sharedJson = []byte(`[
+  { "time": "2018-09-12T09:17:07-03:00", "tags": [ "daily" ], "hostname": "host1", "paths": [ "/etc" ], "short_id": "11111111" },
+  { "time": "2018-09-13T09:17:07-03:00", "tags": [ "daily", "db" ], "hostname": "host1", "paths": [ "/var/lib/db" ], "short_id": "22222222" },
+  { "time": "2018-09-14T09:17:07-03:00", "tags": [ "daily" ], "hostname": "host2", "paths": [ "/etc" ], "short_id": "33333333" },
+  { "time": "2018-09-11T09:17:07-03:00", "tags": [ "weekly" ], "hostname": "host2", "paths": [ "/etc" ], "short_id": "44444444" }
+]`)
+
+func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
 
 	testHelper := getTestHelper(args...)
 	cs := []string{"-test.run=" + testHelper, "--", command}
 	cs = append(cs, args...)
 	log.Println(cs)
-	cmd := exec.Command(os.Args[0], cs...)
+	cmd := exec.CommandContext(ctx, os.Args[0], cs...)
 	return cmd
 }
 
@@ -40,27 +51,31 @@ func getTestHelper(args ...string) string {
 	cmdArgs := strings.Join(args, ", ")
 	if strings.Contains(cmdArgs, "--tag") {
 		helperProcess = "TestHelperTagProcess"
+	} else if len(args) > 0 && args[0] == "snapshots" {
+		helperProcess = "TestHelperSharedProcess"
+	} else if len(args) > 1 && (args[0] == "check" || args[0] == "list" || args[0] == "stats") {
+		helperProcess = "TestHelperHealthProcess"
 	}
 	log.Println(helperProcess)
 	return helperProcess
 }
 
-func fakeExecCommandError(command string, args ...string) *exec.Cmd {
-	cmd := fakeExecCommand(command, args...)
+func fakeExecCommandError(ctx context.Context, command string, args ...string) *exec.Cmd {
+	cmd := fakeExecCommand(ctx, command, args...)
 	return cmd
 }
 
 func TestLatestSnapshots(t *testing.T) {
 
 	execCommand = fakeExecCommand
-	defer func() { execCommand = exec.Command }()
+	defer func() { execCommand = exec.CommandContext }()
 	repo := &ResticRepository{
 		Alias:    "test2",
 		Password: "myPassword",
 		Path:     "myPath",
 	}
 
-	snapshot, err := repo.LatestSnapshot()
+	snapshot, err := repo.LatestSnapshot(context.Background())
 	if err != nil {
 		t.Fatalf("Unexpected error - '%s'", err.Error())
 	}
@@ -73,6 +88,144 @@ func TestLatestSnapshots(t *testing.T) {
 	compareResticSnapshots(t, testResticSnapshot, snapshot)
 }
 
+func TestSnapshots(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	repo := &ResticRepository{
+		Alias:    "test2",
+		Password: "myPassword",
+		Path:     "myPath",
+	}
+
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if len(snapshots) != 1 {
+		t.Fatalf("Expected 1 snapshot but got %d", len(snapshots))
+	}
+	if snapshots[0].Name != "f8da39e9" {
+		t.Errorf("Expected Id %s but got %s", "f8da39e9", snapshots[0].Name)
+	}
+	if snapshots[0].Host != "backup-host" {
+		t.Errorf("Expected Host %s but got %s", "backup-host", snapshots[0].Host)
+	}
+	if len(snapshots[0].Paths) != 1 || snapshots[0].Paths[0] != "/var/lib/data" {
+		t.Errorf("Expected Paths %v but got %v", []string{"/var/lib/data"}, snapshots[0].Paths)
+	}
+}
+
+func TestReport(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	repo := &ResticRepository{Alias: "shared", Hosts: []string{"host2"}}
+
+	report, err := repo.Report(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if report.Latest.Name != "33333333" || len(report.Snapshots) != 2 {
+		t.Errorf("Expected the 2 snapshots of host2 but got %v and %v", report.Latest, report.Snapshots)
+	}
+	if report.Size != nil {
+		t.Errorf("Expected no repository size without the health stats but got %v", *report.Size)
+	}
+
+	// The sizes of the snapshots are computed in background
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		report, err = repo.Report(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error - '%s'", err.Error())
+		}
+		if report.Snapshots[0].Size == 1024 && report.Snapshots[1].Size == 1024 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("The sizes of the snapshots were not computed in background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLatestSnapshotsCancelled(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	repo := &ResticRepository{
+		Alias:    "test2",
+		Password: "myPassword",
+		Path:     "myPath",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := repo.LatestSnapshot(ctx); err == nil {
+		t.Fatalf("Expected an error")
+	}
+}
+
+func TestLatestSnapshotSizeError(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	repo := &ResticRepository{Alias: "shared", Hosts: []string{"host1"}}
+
+	if _, err := repo.LatestSnapshot(context.Background()); err == nil {
+		t.Fatalf("Expected an error when the size of the latest snapshot is unknown")
+	}
+}
+
+func TestBackendOptions(t *testing.T) {
+	var commands []*exec.Cmd
+	execCommand = func(ctx context.Context, command string, args ...string) *exec.Cmd {
+		cmd := fakeExecCommand(ctx, command, args...)
+		commands = append(commands, cmd)
+		return cmd
+	}
+	defer func() { execCommand = exec.CommandContext }()
+	repo := &ResticRepository{
+		Alias:              "test2",
+		Path:               "s3:s3.amazonaws.com/bucket",
+		PasswordFile:       "/etc/restic/password",
+		AWSAccessKeyId:     "key",
+		AWSSecretAccessKey: "secret",
+		CacheDir:           "/var/cache/restic",
+		NoLock:             true,
+		Flags:              []string{"--limit-download", "1024"},
+		Env:                []string{"AWS_PROFILE=backup"},
+	}
+
+	if _, err := repo.LatestSnapshot(context.Background()); err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if len(commands) == 0 {
+		t.Fatal("Expected restic to be run")
+	}
+
+	args := strings.Join(commands[0].Args, " ")
+	for _, expected := range []string{"--no-lock", "--cache-dir /var/cache/restic", "--limit-download 1024"} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("Expected the flag %s but got %s", expected, args)
+		}
+	}
+
+	env := strings.Join(commands[0].Env, "\n")
+	for _, expected := range []string{
+		"RESTIC_REPOSITORY=s3:s3.amazonaws.com/bucket",
+		"RESTIC_PASSWORD_FILE=/etc/restic/password",
+		"AWS_ACCESS_KEY_ID=key",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"AWS_PROFILE=backup",
+	} {
+		if !strings.Contains(env, expected) {
+			t.Errorf("Expected the environment variable %s", expected)
+		}
+	}
+	if strings.Contains(env, "RESTIC_PASSWORD=") {
+		t.Errorf("Expected no RESTIC_PASSWORD when a password file is given")
+	}
+}
+
 func TestHelperProcess(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping testing in short mode")
@@ -80,13 +233,243 @@ func TestHelperProcess(t *testing.T) {
 	os.Exit(0)
 }
 
+func TestSelectors(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	tests := []struct {
+		repo     *ResticRepository
+		expected []string
+	}{
+		{&ResticRepository{Alias: "shared", Hosts: []string{"host1"}}, []string{"11111111", "22222222"}},
+		{&ResticRepository{Alias: "shared", Paths: []string{"/etc"}}, []string{"11111111", "33333333", "44444444"}},
+		{&ResticRepository{Alias: "shared", Hosts: []string{"host2"}, Paths: []string{"/etc"}}, []string{"33333333", "44444444"}},
+	}
+	for _, test := range tests {
+		snapshots, err := test.repo.Snapshots(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error - '%s'", err.Error())
+		}
+		var names []string
+		for _, snapshot := range snapshots {
+			names = append(names, snapshot.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Expected the snapshots %v but got %v", test.expected, names)
+		}
+	}
+
+	repo := &ResticRepository{Alias: "shared", Hosts: []string{"host1", "host2"}}
+	latest, err := repo.latestSelectedSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if latest.Id != "33333333" {
+		t.Errorf("Expected the latest snapshot 33333333 but got %s", latest.Id)
+	}
+}
+
+func TestTagLists(t *testing.T) {
+	repo := &ResticRepository{Alias: "shared", Tags: []string{"daily,db", "weekly"}}
+	tests := []struct {
+		tags     []string
+		expected bool
+	}{
+		{[]string{"daily"}, false},
+		{[]string{"daily", "db"}, true},
+		{[]string{"weekly"}, true},
+		{[]string{"shared"}, false},
+	}
+	for _, test := range tests {
+		if matched := repo.matches(test.tags, "host", nil); matched != test.expected {
+			t.Errorf("Expected %v for the tags %v but got %v", test.expected, test.tags, matched)
+		}
+	}
+
+	repo = &ResticRepository{Alias: "shared"}
+	if !repo.matches([]string{"shared"}, "host", nil) || repo.matches([]string{"other"}, "host", nil) {
+		t.Errorf("Expected the alias to be the tag without selectors")
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	tests := map[string][]string{
+		GroupByHost:      {"shared/host1", "shared/host2"},
+		GroupByPaths:     {"shared:/etc", "shared:/var/lib/db"},
+		GroupByHostPaths: {"shared/host1:/etc", "shared/host1:/var/lib/db", "shared/host2:/etc"},
+	}
+	for groupBy, expected := range tests {
+		group := &ResticGroup{&ResticRepository{Alias: "shared", GroupBy: groupBy}}
+		members, err := group.Members(context.Background())
+		if err != nil {
+			t.Fatalf("Unexpected error - '%s'", err.Error())
+		}
+		var aliases []string
+		for _, member := range members {
+			aliases = append(aliases, member.AliasName())
+		}
+		if strings.Join(aliases, " ") != strings.Join(expected, " ") {
+			t.Errorf("Expected the members %v for %s but got %v", expected, groupBy, aliases)
+		}
+	}
+
+	group := &ResticGroup{&ResticRepository{Alias: "shared", GroupBy: GroupByHostPaths}}
+	members, err := group.Members(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	snapshots, err := members[2].(*ResticRepository).Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if len(snapshots) != 2 || snapshots[0].Host != "host2" {
+		t.Errorf("Expected the 2 snapshots of host2 but got %v", snapshots)
+	}
+
+	// The health of the repository is only reported by the first member
+	health := group.healthState()
+	health.mutex.Lock()
+	health.statsStarted = time.Now()
+	health.stats = []collector.Metric{{Name: "backup_blob_count", Value: 12}}
+	health.mutex.Unlock()
+	group.Health.StatsInterval = time.Hour
+	members, err = group.Members(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	for idx, member := range members {
+		metrics := member.(*ResticRepository).healthMetrics()
+		if idx == 0 && len(metrics) != 1 || idx > 0 && len(metrics) != 0 {
+			t.Errorf("%s - Expected the health metrics on the first member only but got %v", member.AliasName(), metrics)
+		}
+	}
+
+	group = &ResticGroup{&ResticRepository{Alias: "shared", GroupBy: "hostname"}}
+	if _, err := group.Members(context.Background()); err == nil {
+		t.Errorf("Expected an error for an unknown group_by")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	repo := &ResticRepository{Alias: "test2", Path: "broken"}
+	values := make(map[string]float64)
+	for _, metric := range repo.check(context.Background()) {
+		values[metric.Name] = metric.Value
+	}
+	if values["backup_check_success"] != 0 || values["backup_check_errors"] != 2 {
+		t.Errorf("Expected a failed check with 2 errors but got %v", values)
+	}
+
+	passing := &ResticRepository{Alias: "test2", Path: "myPath"}
+	for _, metric := range passing.check(context.Background()) {
+		values[metric.Name] = metric.Value
+	}
+	if values["backup_check_success"] != 1 || values["backup_check_errors"] != 0 {
+		t.Errorf("Expected a passing check without errors but got %v", values)
+	}
+
+	metrics, size, err := repo.stats(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if size != 1024 {
+		t.Errorf("Expected the repository size 1024 but got %v", size)
+	}
+	for _, metric := range metrics {
+		values[metric.Name] = metric.Value
+	}
+	expected := map[string]float64{
+		"backup_restore_size_bytes":  4096,
+		"backup_blob_count":          12,
+		"backup_pack_count":          3,
+		"backup_deduplication_ratio": 4,
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("Expected %s %v but got %v", name, value, values[name])
+		}
+	}
+}
+
+func TestHealthSchedule(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	repo := &ResticRepository{Alias: "test2", Path: "myPath"}
+	repo.Health.StatsInterval = time.Hour
+	if metrics := repo.healthMetrics(); len(metrics) != 0 {
+		t.Errorf("Expected no metrics before the first run but got %v", metrics)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(repo.healthMetrics()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The stats were not collected in background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	health := repo.healthState()
+	health.mutex.Lock()
+	started := health.statsStarted
+	health.mutex.Unlock()
+	repo.healthMetrics()
+	if health.statsStarted != started {
+		t.Errorf("Expected the stats to run once per interval")
+	}
+}
+
+func TestHelperHealthProcess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping testing in short mode")
+	}
+	args := strings.Join(os.Args, " ")
+	switch {
+	case strings.Contains(args, "stats 22222222"):
+		fmt.Fprintln(os.Stderr, "Fatal: unable to load snapshot 22222222")
+		os.Exit(1)
+	case strings.Contains(args, "check") && os.Getenv("RESTIC_REPOSITORY") == "broken":
+		fmt.Fprintln(os.Stdout, `{"message_type":"error","error":{"message":"tree 4bba301e: tree not found"}}`)
+		fmt.Fprintln(os.Stdout, `{"message_type":"error","error":{"message":"pack 0a5e8e81: not referenced in any index"}}`)
+		fmt.Fprintln(os.Stdout, `{"message_type":"summary","num_errors":2,"broken_packs":null,"suggest_repair_index":true}`)
+		fmt.Fprintln(os.Stderr, "Fatal: repository contains errors")
+		os.Exit(1)
+	case strings.Contains(args, "check"):
+		fmt.Fprintln(os.Stdout, "using temporary cache in /tmp/restic-check-cache-1")
+		fmt.Fprintln(os.Stdout, "no errors were found")
+	case strings.Contains(args, "restore-size"):
+		fmt.Fprint(os.Stdout, `{"total_size": 4096, "total_file_count": 10}`)
+	case strings.Contains(args, "raw-data"):
+		fmt.Fprint(os.Stdout, `{"total_size": 1024, "total_blob_count": 12}`)
+	case strings.Contains(args, "packs"):
+		fmt.Fprintln(os.Stdout, "0a5e8e81cbd7a2e1c3b7f0d4f4e1b1b5d1d6a1e3c2f5b7a9d0e1f2a3b4c5d6e7")
+		fmt.Fprintln(os.Stdout, "1b6f9f92dce8b3f2d4c8a1e5a5f2c2c6e2e7b2f4d3a6c8b0e1f2a3b4c5d6e7f8")
+		fmt.Fprintln(os.Stdout, "2c7a0a03edf9c4a3e5d9b2f6b6a3d3d7f3f8c3a5e4b7d9c1f2a3b4c5d6e7f8a9")
+	}
+	os.Exit(0)
+}
+
+func TestHelperSharedProcess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping testing in short mode")
+	}
+	fmt.Fprintf(os.Stdout, "%s", sharedJson)
+	os.Exit(0)
+}
+
 func TestHelperTagProcess(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping testing in short mode")
 	}
 	for idx, arg := range os.Args[1:] {
 		if arg == "--tag" {
-			templateName := strings.Split(os.Args[idx+2], "=")[1]
+			templateName := os.Args[idx+2]
 			switch templateName {
 			case "test1":
 				fmt.Fprintf(os.Stdout, "[ %s ]", test1Json)
@@ -0,0 +1,94 @@
+package restic
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Holds the sizes of the snapshots of a repository by id, a snapshot never
+// changes once taken. The missing sizes are computed in background as a
+// restic stats run for each snapshot would not fit in the refreshes.
+type snapshotSizes struct {
+	mutex   sync.Mutex
+	sizes   map[string]float64
+	filling bool
+}
+
+// Guards the lazy creation of the sizes of the repositories
+var sizesMutex sync.Mutex
+
+func (r *ResticRepository) sizeState() *snapshotSizes {
+	sizesMutex.Lock()
+	defer sizesMutex.Unlock()
+	if r.sizes == nil {
+		r.sizes = &snapshotSizes{sizes: make(map[string]float64)}
+	}
+	return r.sizes
+}
+
+// Returns the size of the snapshot, false when it is not known yet
+func (s *snapshotSizes) get(id string) (float64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	size, ok := s.sizes[id]
+	return size, ok
+}
+
+func (s *snapshotSizes) set(id string, size float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sizes[id] = size
+}
+
+// Forgets the sizes of the snapshots that are no longer listed
+func (s *snapshotSizes) prune(ids []string) {
+	listed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		listed[id] = true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id := range s.sizes {
+		if !listed[id] {
+			delete(s.sizes, id)
+		}
+	}
+}
+
+// Starts computing in background the sizes of the given snapshots missing from
+// the cache, one snapshot at a time. They are reported by the following refreshes.
+func (r *ResticRepository) fillSizes(ids []string, snapshotSize func(ctx context.Context, id string) (float64, error)) {
+	sizes := r.sizeState()
+	sizes.mutex.Lock()
+	var missing []string
+	for _, id := range ids {
+		if _, ok := sizes.sizes[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if sizes.filling || len(missing) == 0 {
+		sizes.mutex.Unlock()
+		return
+	}
+	sizes.filling = true
+	sizes.mutex.Unlock()
+
+	go r.runHealth(func(ctx context.Context) {
+		defer func() {
+			sizes.mutex.Lock()
+			sizes.filling = false
+			sizes.mutex.Unlock()
+		}()
+
+		for _, id := range missing {
+			size, err := snapshotSize(ctx, id)
+			if err != nil {
+				log.Printf("failed to retrieve the size of the snapshot %s of %v: %s", id, r.Alias, err.Error())
+				return
+			}
+			sizes.set(id, size)
+		}
+	})
+}
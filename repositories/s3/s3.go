@@ -0,0 +1,274 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+const defaultRegion = "us-east-1"
+
+// Represents the informations about a bucket holding backup files,
+// reachable through any S3 compatible API
+type S3Repo struct {
+	// The repository alias
+	Alias,
+	// The URL of the S3 compatible API, e.g. https://s3.amazonaws.com or http://minio:9000
+	Endpoint,
+	// The region of the bucket, defaults to us-east-1
+	Region,
+	// The bucket holding the backups
+	Bucket,
+	// Optional prefix of the backup objects
+	Prefix,
+	// Optional extension of the backup objects
+	Extension,
+	// Optional regular expression the object keys must match
+	Pattern string
+	// The access key of the static credentials, requests are anonymous when empty
+	AccessKey string `mapstructure:"access_key"`
+	// The secret key of the static credentials
+	SecretKey string `mapstructure:"secret_key"`
+	// Optional session token of temporary credentials
+	SessionToken string `mapstructure:"session_token"`
+	// Addresses the bucket in the path instead of the host name, as usually
+	// required by MinIO and other self-hosted implementations
+	PathStyle bool `mapstructure:"path_style"`
+
+	collector.RepositoryOptions `mapstructure:",squash"`
+}
+
+type listBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []s3Object
+}
+
+type s3Object struct {
+	Key          string
+	LastModified time.Time
+	Size         float64
+}
+
+func OpenRepository(alias, endpoint, bucket, prefix string) *S3Repo {
+	return &S3Repo{
+		Alias:    alias,
+		Endpoint: endpoint,
+		Bucket:   bucket,
+		Prefix:   prefix,
+	}
+}
+
+// Returns the repository alias
+func (s *S3Repo) AliasName() string {
+	return s.Alias
+}
+
+// Returns the repository type
+func (s *S3Repo) TypeName() string {
+	return "s3"
+}
+
+// Returns the URL listing the bucket
+func (s *S3Repo) bucketURL() (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.PathStyle {
+		u.Path = path.Join("/", u.Path, s.Bucket) + "/"
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/"
+	}
+	return u, nil
+}
+
+// Returns the objects matching the extension and pattern, newest first
+func (s *S3Repo) listObjects(ctx context.Context) ([]s3Object, error) {
+	var pattern *regexp.Regexp
+	if s.Pattern != "" {
+		var err error
+		pattern, err = regexp.Compile(s.Pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	extension := s.Extension
+	if extension != "" && !strings.HasPrefix(extension, ".") {
+		extension = "." + extension
+	}
+
+	var objects []s3Object
+	token := ""
+	for {
+		page, err := s.listPage(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range page.Contents {
+			if !strings.HasSuffix(object.Key, extension) || strings.HasSuffix(object.Key, "/") {
+				continue
+			}
+			if pattern != nil && !pattern.MatchString(object.Key) {
+				continue
+			}
+			objects = append(objects, object)
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].LastModified.After(objects[j].LastModified)
+	})
+	return objects, nil
+}
+
+// Retrieves a page of the objects under the prefix with ListObjectsV2
+func (s *S3Repo) listPage(ctx context.Context, token string) (*listBucketResult, error) {
+	u, err := s.bucketURL()
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	if s.Prefix != "" {
+		query.Set("prefix", s.Prefix)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.AccessKey != "" {
+		region := s.Region
+		if region == "" {
+			region = defaultRegion
+		}
+		creds := &credentials{s.AccessKey, s.SecretKey, s.SessionToken, region}
+		creds.sign(req, time.Now())
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, collector.ErrAuthentication
+	case http.StatusNotFound:
+		return nil, collector.ErrSnapshotNotFound
+	default:
+		return nil, fmt.Errorf("http error %d: %s", resp.StatusCode, body)
+	}
+
+	result := &listBucketResult{}
+	err = xml.Unmarshal(body, result)
+	if err != nil {
+		return nil, &collector.ParseError{Err: err}
+	}
+	return result, nil
+}
+
+func (object *s3Object) backupSnapshot() *collector.BackupSnapshot {
+	return &collector.BackupSnapshot{
+		Name:       object.Key,
+		DateString: object.LastModified.UTC().Format(time.UnixDate),
+		Size:       object.Size,
+	}
+}
+
+// Retrieves informations about the newest backup object of the bucket
+func (s *S3Repo) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := s.Report(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return report.Latest, nil
+}
+
+// Retrieves the newest backup object, all the backup objects and their size
+// from a single listing of the bucket
+func (s *S3Repo) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+
+	log.Println("Retrieving snapshot informations from bucket - ", s.Bucket)
+
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(objects) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	snapshots := backupSnapshots(objects)
+	size := objectsSize(objects)
+	return &collector.RepositoryReport{Latest: snapshots[0], Snapshots: snapshots, Size: &size}, nil
+}
+
+func backupSnapshots(objects []s3Object) []*collector.BackupSnapshot {
+	var snapshots []*collector.BackupSnapshot
+	for _, object := range objects {
+		snapshots = append(snapshots, object.backupSnapshot())
+	}
+	return snapshots
+}
+
+func objectsSize(objects []s3Object) float64 {
+	var size float64
+	for _, object := range objects {
+		size += object.Size
+	}
+	return size
+}
+
+// Retrieves informations about all the backup objects of the bucket, newest first
+func (s *S3Repo) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return backupSnapshots(objects), nil
+}
+
+// Retrieves the size of all the backup objects of the bucket
+func (s *S3Repo) RepositorySize(ctx context.Context) (float64, error) {
+	objects, err := s.listObjects(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return objectsSize(objects), nil
+}
@@ -0,0 +1,282 @@
+package velero
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+	"gopkg.in/yaml.v3"
+)
+
+// Directory holding the credentials of the pod service account
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Represents the subset of a kubeconfig file used to reach the API server
+type kubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster kubeCluster
+	}
+	Contexts []struct {
+		Name    string
+		Context struct {
+			Cluster string
+			User    string
+		}
+	}
+	Users []struct {
+		Name string
+		User kubeUser
+	}
+}
+
+type kubeCluster struct {
+	Server                   string
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+}
+
+type kubeUser struct {
+	Token                 string
+	TokenFile             string `yaml:"tokenFile"`
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+	Username              string
+	Password              string
+	Exec                  map[string]interface{}
+	AuthProvider          map[string]interface{} `yaml:"auth-provider"`
+}
+
+// Sends the requests to the Kubernetes API server with the credentials of the
+// kubeconfig user or of the pod service account
+type apiClient struct {
+	server string
+	client *http.Client
+	token  string
+	// Read on every request, as service account tokens are rotated
+	tokenFile          string
+	username, password string
+}
+
+// Returns the file content, or the decoded data when the file is not set.
+// Relative files are resolved from the directory of the kubeconfig file.
+func fileOrData(dir, file, data string) ([]byte, error) {
+	if file != "" {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		return ioutil.ReadFile(file)
+	}
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	return nil, nil
+}
+
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// Builds the client of the context of the kubeconfig file, its current context when empty
+func kubeconfigClient(file, contextName string) (*apiClient, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decoded as is, the names and keys may hold dots and upper case letters
+	var config kubeConfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, &collector.ParseError{Err: err}
+	}
+
+	if contextName == "" {
+		contextName = config.CurrentContext
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range config.Contexts {
+		if c.Name == contextName {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in %s", contextName, file)
+	}
+
+	var cluster *kubeCluster
+	for idx := range config.Clusters {
+		if config.Clusters[idx].Name == clusterName {
+			cluster = &config.Clusters[idx].Cluster
+		}
+	}
+	if cluster == nil {
+		return nil, fmt.Errorf("cluster %q not found in %s", clusterName, file)
+	}
+	user := &kubeUser{}
+	for idx := range config.Users {
+		if config.Users[idx].Name == userName {
+			user = &config.Users[idx].User
+		}
+	}
+	if len(user.Exec) > 0 || len(user.AuthProvider) > 0 {
+		return nil, fmt.Errorf("user %q relies on a credential plugin, which is not supported", userName)
+	}
+
+	dir := filepath.Dir(file)
+	tlsConfig := &tls.Config{InsecureSkipVerify: cluster.InsecureSkipTLSVerify}
+	ca, err := fileOrData(dir, cluster.CertificateAuthority, cluster.CertificateAuthorityData)
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificate authority found for cluster " + clusterName)
+		}
+	}
+
+	cert, err := fileOrData(dir, user.ClientCertificate, user.ClientCertificateData)
+	if err != nil {
+		return nil, err
+	}
+	key, err := fileOrData(dir, user.ClientKey, user.ClientKeyData)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil || key != nil {
+		certificate, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	tokenFile := user.TokenFile
+	if tokenFile != "" && !filepath.IsAbs(tokenFile) {
+		tokenFile = filepath.Join(dir, tokenFile)
+	}
+	return &apiClient{
+		server:    cluster.Server,
+		client:    &http.Client{Transport: newTransport(tlsConfig)},
+		token:     user.Token,
+		tokenFile: tokenFile,
+		username:  user.Username,
+		password:  user.Password,
+	}, nil
+}
+
+// Builds the client of the service account of the pod the exporter runs in
+func inClusterClient() (*apiClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster and no kubeconfig set")
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificate authority found in the service account")
+	}
+
+	return &apiClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		client:    &http.Client{Transport: newTransport(tlsConfig)},
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+	}, nil
+}
+
+// Sets the credentials of the client on the request
+func (c *apiClient) authenticate(req *http.Request) error {
+	token := c.token
+	if c.tokenFile != "" {
+		content, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return nil
+}
+
+// Sends a GET request to the API server and decodes the JSON answer into v
+func (c *apiClient) get(ctx context.Context, v interface{}, query url.Values, elem ...string) error {
+	u, err := url.Parse(c.server)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(append([]string{u.Path}, elem...)...)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := c.authenticate(req); err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return collector.ErrAuthentication
+	case http.StatusNotFound:
+		return collector.ErrSnapshotNotFound
+	default:
+		return fmt.Errorf("http error %d", resp.StatusCode)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return &collector.ParseError{Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package velero
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+func TestKubeconfigCredentials(t *testing.T) {
+	t.Log("Testing the credentials of the kubeconfig users")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		expected error
+	}{
+		{"token", "    token: secret", nil},
+		{"relative token file", "    tokenFile: token", nil},
+		{"wrong token", "    token: wrong", collector.ErrAuthentication},
+	}
+	for _, test := range tests {
+		ts := setupAPITest(t, "secret", "")
+		repo := OpenRepository("testRepo", "")
+		repo.Kubeconfig = writeKubeconfig(t, dir, ts, test.user)
+
+		if _, err := repo.Snapshots(context.Background()); err != test.expected {
+			t.Errorf("%s - Expected %v but got %v", test.name, test.expected, err)
+		}
+		ts.Close()
+	}
+}
+
+func TestKubeconfigContext(t *testing.T) {
+	t.Log("Testing the selection of the kubeconfig context")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ts := setupAPITest(t, "secret", "")
+	defer ts.Close()
+
+	repo := OpenRepository("testRepo", "")
+	repo.Kubeconfig = writeKubeconfig(t, dir, ts, "    token: secret")
+	repo.Context = "other"
+	_, err := repo.Snapshots(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "other-cluster") {
+		t.Errorf("Expected the cluster of the context to be missing but got %v", err)
+	}
+
+	repo = OpenRepository("testRepo", "")
+	repo.Kubeconfig = writeKubeconfig(t, dir, ts, "    exec:\n      command: aws")
+	_, err = repo.Snapshots(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "credential plugin") {
+		t.Errorf("Expected credential plugins to be rejected but got %v", err)
+	}
+}
+
+func TestKubeconfigNames(t *testing.T) {
+	t.Log("Testing the kubeconfig names holding dots and upper case letters")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ts := setupAPITest(t, "secret", "")
+	defer ts.Close()
+
+	file := writeKubeconfig(t, dir, ts, "    token: secret")
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacer := strings.NewReplacer("test-cluster", "Prod.Example.com", "test-user", "Admin@Prod.Example.com",
+		"current-context: test", "current-context: Admin@Prod.Example.com", "- name: test\n", "- name: Admin@Prod.Example.com\n")
+	if err := ioutil.WriteFile(file, []byte(replacer.Replace(string(content))), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := OpenRepository("testRepo", "")
+	repo.Kubeconfig = file
+	if _, err := repo.Snapshots(context.Background()); err != nil {
+		t.Errorf("Unexpected error - '%s'", err.Error())
+	}
+}
+
+func TestKubeconfigRetry(t *testing.T) {
+	t.Log("Testing that the client is built again once it failed")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ts := setupAPITest(t, "secret", "")
+	defer ts.Close()
+
+	repo := OpenRepository("testRepo", "")
+	repo.Kubeconfig = filepath.Join(dir, "config")
+	if _, err := repo.Snapshots(context.Background()); err == nil {
+		t.Errorf("Expected an error for a missing kubeconfig file")
+	}
+
+	writeKubeconfig(t, dir, ts, "    token: secret")
+	if _, err := repo.Snapshots(context.Background()); err != nil {
+		t.Errorf("Unexpected error - '%s'", err.Error())
+	}
+}
+
+func TestInCluster(t *testing.T) {
+	t.Log("Testing the service account of the pod")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ts := setupAPITest(t, "secret", "")
+	defer ts.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { serviceAccountDir = dir }(serviceAccountDir)
+	serviceAccountDir = dir
+	for name, value := range map[string]string{"KUBERNETES_SERVICE_HOST": host, "KUBERNETES_SERVICE_PORT": port, "KUBECONFIG": ""} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	repo := OpenRepository("testRepo", "velero")
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+	if len(snapshots) != 1 {
+		t.Errorf("Expected the completed snapshot but got %d", len(snapshots))
+	}
+}
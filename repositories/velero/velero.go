@@ -0,0 +1,309 @@
+package velero
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+// Namespace Velero is installed in when not configured
+const DefaultNamespace = "velero"
+
+// Label set by Velero on the backups created by a schedule
+const scheduleLabel = "velero.io/schedule-name"
+
+// Phases of the finished backups, exported by the backup_newest_snapshot_phase metric.
+// Backups in the other phases are still running or being deleted.
+var finishedPhases = []string{"Completed", "PartiallyFailed", "Failed", "FailedValidation"}
+
+// Phase of the backups that fully succeeded, the latest backup is the newest
+// one of them so failed backups do not count as fresh backups
+const phaseCompleted = "Completed"
+
+// Number of backups requested per page of the list
+const pageSize = "500"
+
+// Represents a velero.io/v1 Backup resource
+type veleroBackup struct {
+	Metadata struct {
+		Name              string            `json:"name"`
+		Labels            map[string]string `json:"labels"`
+		CreationTimestamp time.Time         `json:"creationTimestamp"`
+	} `json:"metadata"`
+	Status struct {
+		Phase               string     `json:"phase"`
+		StartTimestamp      *time.Time `json:"startTimestamp"`
+		CompletionTimestamp *time.Time `json:"completionTimestamp"`
+		Progress            struct {
+			TotalItems    float64 `json:"totalItems"`
+			ItemsBackedUp float64 `json:"itemsBackedUp"`
+		} `json:"progress"`
+		Warnings float64 `json:"warnings"`
+		Errors   float64 `json:"errors"`
+	} `json:"status"`
+}
+
+type veleroBackupList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []veleroBackup `json:"items"`
+}
+
+// Represents the informations about the Velero backups of a Kubernetes cluster
+// used to retrieve informations about the latest one
+type VeleroRepository struct {
+	// The repository alias
+	Alias,
+	// Optional namespace Velero is installed in, defaults to velero
+	Namespace,
+	// Optional kubeconfig file, the service account of the pod is used when empty
+	Kubeconfig,
+	// Optional context of the kubeconfig file, defaults to its current context
+	Context string
+	// Optional label selector the backups must match, e.g. 'app=db,tier!=cache'
+	LabelSelector string `mapstructure:"label_selector"`
+	// Optional schedule the backups were created by
+	Schedule string
+
+	clientMutex sync.Mutex
+	client      *apiClient
+
+	collector.RepositoryOptions `mapstructure:",squash"`
+}
+
+func OpenRepository(alias, namespace string) *VeleroRepository {
+	return &VeleroRepository{
+		Alias:     alias,
+		Namespace: namespace,
+	}
+}
+
+// Builds the API client of the repository, it is then shared by all its requests.
+// It is built again by the next request when it failed, e.g. on a missing file.
+func (r *VeleroRepository) apiClient() (*apiClient, error) {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	if r.client != nil {
+		return r.client, nil
+	}
+
+	kubeconfig := r.Kubeconfig
+	if kubeconfig == "" {
+		kubeconfig = strings.Split(os.Getenv("KUBECONFIG"), string(filepath.ListSeparator))[0]
+	}
+	var err error
+	if kubeconfig != "" {
+		r.client, err = kubeconfigClient(kubeconfig, r.Context)
+	} else {
+		r.client, err = inClusterClient()
+	}
+	return r.client, err
+}
+
+func (r *VeleroRepository) namespace() string {
+	if r.Namespace != "" {
+		return r.Namespace
+	}
+	return DefaultNamespace
+}
+
+// Returns the label selector combining the configured one and the schedule
+func (r *VeleroRepository) selector() string {
+	var selectors []string
+	if r.LabelSelector != "" {
+		selectors = append(selectors, r.LabelSelector)
+	}
+	if r.Schedule != "" {
+		selectors = append(selectors, scheduleLabel+"="+r.Schedule)
+	}
+	return strings.Join(selectors, ",")
+}
+
+// Lists the finished backups matching the selector, page by page
+func (r *VeleroRepository) listBackups(ctx context.Context) ([]veleroBackup, error) {
+	client, err := r.apiClient()
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"limit": {pageSize}}
+	if selector := r.selector(); selector != "" {
+		query.Set("labelSelector", selector)
+	}
+
+	var backups []veleroBackup
+	for {
+		var list veleroBackupList
+		err := client.get(ctx, &list, query, "apis/velero.io/v1/namespaces", r.namespace(), "backups")
+		if err != nil {
+			return nil, err
+		}
+		for _, backup := range list.Items {
+			if backup.finished() {
+				backups = append(backups, backup)
+			}
+		}
+		if list.Metadata.Continue == "" {
+			return backups, nil
+		}
+		query.Set("continue", list.Metadata.Continue)
+	}
+}
+
+func (backup *veleroBackup) finished() bool {
+	for _, phase := range finishedPhases {
+		if backup.Status.Phase == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the time the backup started, or was created when it never started
+func (backup *veleroBackup) startTime() time.Time {
+	if backup.Status.StartTimestamp != nil {
+		return *backup.Status.StartTimestamp
+	}
+	return backup.Metadata.CreationTimestamp
+}
+
+// Returns the time the backup finished, or started when it was not recorded
+func (backup *veleroBackup) completionTime() time.Time {
+	if backup.Status.CompletionTimestamp != nil {
+		return *backup.Status.CompletionTimestamp
+	}
+	return backup.startTime()
+}
+
+// Velero does not report the size of the backups, it is left out
+func (backup *veleroBackup) backupSnapshot() *collector.BackupSnapshot {
+	var tags []string
+	if schedule := backup.Metadata.Labels[scheduleLabel]; schedule != "" {
+		tags = []string{schedule}
+	}
+	return &collector.BackupSnapshot{
+		Name:       backup.Metadata.Name,
+		DateString: backup.startTime().UTC().Format(time.UnixDate),
+		Tags:       tags,
+	}
+}
+
+// Returns the metrics of the latest backup, along with the phase of the newest finished backup
+func (backup *veleroBackup) metrics(newest *veleroBackup) []collector.Metric {
+	metrics := []collector.Metric{
+		{
+			Name:  "backup_last_snapshot_completion_timestamp_seconds",
+			Help:  "The time the latest backup finished as a Unix timestamp, Velero only",
+			Value: float64(backup.completionTime().Unix()),
+		},
+		{
+			Name:  "backup_last_snapshot_items",
+			Help:  "The number of items saved by the latest backup, Velero only",
+			Value: backup.Status.Progress.ItemsBackedUp,
+		},
+		{
+			Name:  "backup_last_snapshot_warnings",
+			Help:  "The number of warnings encountered by the latest backup, Velero only",
+			Value: backup.Status.Warnings,
+		},
+		{
+			Name:  "backup_last_snapshot_errors",
+			Help:  "The number of errors encountered by the latest snapshot, Kopia and Velero only",
+			Value: backup.Status.Errors,
+		},
+	}
+	// The latest backup is always completed, only the phase of the newest one is reported
+	return append(metrics, phaseMetrics("backup_newest_snapshot_phase",
+		"1 for the phase of the newest finished backup, whatever it is, 0 for the others, Velero only", newest.Status.Phase)...)
+}
+
+// Returns a metric for each finished phase, 1 for the given phase and 0 for the others
+func phaseMetrics(name, help, current string) []collector.Metric {
+	var metrics []collector.Metric
+	for _, phase := range finishedPhases {
+		value := 0.0
+		if current == phase {
+			value = 1
+		}
+		metrics = append(metrics, collector.Metric{
+			Name:   name,
+			Help:   help,
+			Labels: map[string]string{"phase": phase},
+			Value:  value,
+		})
+	}
+	return metrics
+}
+
+// Returns the alias of the Velero repository
+func (r *VeleroRepository) AliasName() string {
+	return r.Alias
+}
+
+// Returns the repository type
+func (r *VeleroRepository) TypeName() string {
+	return "velero"
+}
+
+// Retrieves informations about the completed backup that finished last
+func (r *VeleroRepository) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := r.Report(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return report.Latest, nil
+}
+
+// Retrieves the completed backup that finished last and all the completed
+// backups from a single listing, Velero does not report their size
+func (r *VeleroRepository) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+	backups, err := r.listBackups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest, newest *veleroBackup
+	for i := range backups {
+		backup := &backups[i]
+		if newest == nil || backup.completionTime().After(newest.completionTime()) {
+			newest = backup
+		}
+		if backup.Status.Phase == phaseCompleted && (latest == nil || backup.completionTime().After(latest.completionTime())) {
+			latest = backup
+		}
+	}
+	if latest == nil {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	backupSnapshot := latest.backupSnapshot()
+	backupSnapshot.Metrics = latest.metrics(newest)
+	return &collector.RepositoryReport{Latest: backupSnapshot, Snapshots: completedSnapshots(backups)}, nil
+}
+
+// Returns the completed backups, the failed ones do not count in the history
+func completedSnapshots(backups []veleroBackup) []*collector.BackupSnapshot {
+	var snapshots []*collector.BackupSnapshot
+	for _, backup := range backups {
+		if backup.Status.Phase == phaseCompleted {
+			snapshots = append(snapshots, backup.backupSnapshot())
+		}
+	}
+	return snapshots
+}
+
+// Retrieves informations about all the completed backups
+func (r *VeleroRepository) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+	backups, err := r.listBackups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return completedSnapshots(backups), nil
+}
@@ -0,0 +1,308 @@
+package velero
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var firstPageJson = []byte(`{
+  "apiVersion": "velero.io/v1",
+  "kind": "BackupList",
+  "metadata": { "continue": "page2", "resourceVersion": "1234" },
+  "items": [
+    {
+      "metadata": {
+        "name": "daily-20180911091707",
+        "namespace": "velero",
+        "labels": { "velero.io/schedule-name": "daily" },
+        "creationTimestamp": "2018-09-11T09:17:07Z"
+      },
+      "status": {
+        "phase": "Completed",
+        "startTimestamp": "2018-09-11T09:17:07Z",
+        "completionTimestamp": "2018-09-11T09:20:07Z",
+        "progress": { "totalItems": 118, "itemsBackedUp": 118 }
+      }
+    },
+    {
+      "metadata": {
+        "name": "daily-20180912091707",
+        "namespace": "velero",
+        "labels": { "velero.io/schedule-name": "daily" },
+        "creationTimestamp": "2018-09-12T09:17:07Z"
+      },
+      "status": {
+        "phase": "PartiallyFailed",
+        "startTimestamp": "2018-09-12T09:17:07Z",
+        "completionTimestamp": "2018-09-12T09:21:32Z",
+        "progress": { "totalItems": 120, "itemsBackedUp": 117 },
+        "warnings": 2,
+        "errors": 3
+      }
+    }
+  ]
+}`)
+
+var secondPageJson = []byte(`{
+  "apiVersion": "velero.io/v1",
+  "kind": "BackupList",
+  "metadata": { "resourceVersion": "1234" },
+  "items": [
+    {
+      "metadata": {
+        "name": "daily-20180913091707",
+        "namespace": "velero",
+        "labels": { "velero.io/schedule-name": "daily" },
+        "creationTimestamp": "2018-09-13T09:17:07Z"
+      },
+      "status": {
+        "phase": "InProgress",
+        "startTimestamp": "2018-09-13T09:17:07Z",
+        "progress": { "totalItems": 120, "itemsBackedUp": 40 }
+      }
+    },
+    {
+      "metadata": {
+        "name": "manual-20180911120000",
+        "namespace": "velero",
+        "creationTimestamp": "2018-09-11T12:00:00Z"
+      },
+      "status": {
+        "phase": "FailedValidation"
+      }
+    }
+  ]
+}`)
+
+// The number of listings received by the test server
+var listRequests int
+
+// Serves the backups of the velero namespace in two pages, only answering the
+// requests holding the token and the expected label selector
+func setupAPITest(t *testing.T, token, selector string) *httptest.Server {
+	listRequests = 0
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/apis/velero.io/v1/namespaces/velero/backups" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("labelSelector") != selector || query.Get("limit") != pageSize {
+			t.Errorf("Unexpected query %s", r.URL.RawQuery)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if query.Get("continue") == "page2" {
+			w.Write(secondPageJson)
+			return
+		}
+		listRequests++
+		w.Write(firstPageJson)
+	}))
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "velero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Writes a kubeconfig file reaching the server with the given user settings
+func writeKubeconfig(t *testing.T, dir string, ts *httptest.Server, user string) string {
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	content := fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: test-cluster
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+contexts:
+- name: other
+  context:
+    cluster: other-cluster
+    user: test-user
+- name: test
+  context:
+    cluster: test-cluster
+    user: test-user
+    namespace: default
+users:
+- name: test-user
+  user:
+%s
+`, ts.URL, base64.StdEncoding.EncodeToString(ca), user)
+
+	file := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func setupTest(t *testing.T, dir, selector string) (*VeleroRepository, func()) {
+	ts := setupAPITest(t, "secret", selector)
+	repo := OpenRepository("testRepo", "")
+	repo.Kubeconfig = writeKubeconfig(t, dir, ts, "    token: secret")
+	return repo, ts.Close
+}
+
+// Returns the value of the metric with the given name and labels
+func metricValue(metrics []collector.Metric, name string, labels map[string]string) (float64, bool) {
+	for _, metric := range metrics {
+		if metric.Name != name || len(metric.Labels) != len(labels) {
+			continue
+		}
+		matches := true
+		for key, value := range labels {
+			if metric.Labels[key] != value {
+				matches = false
+			}
+		}
+		if matches {
+			return metric.Value, true
+		}
+	}
+	return 0, false
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repo, teardown := setupTest(t, dir, "")
+	defer teardown()
+
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	// The newer partially failed backup is not the latest one
+	if snapshot.Name != "daily-20180911091707" {
+		t.Errorf("Name - Expected %s but got %s", "daily-20180911091707", snapshot.Name)
+	}
+
+	expected := time.Date(2018, 9, 11, 9, 17, 7, 0, time.UTC).Format(time.UnixDate)
+	if snapshot.DateString != expected {
+		t.Errorf("Date - Expected %s but got %s", expected, snapshot.DateString)
+	}
+
+	if len(snapshot.Tags) != 1 || snapshot.Tags[0] != "daily" {
+		t.Errorf("Tags - Expected the schedule but got %v", snapshot.Tags)
+	}
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected float64
+	}{
+		{"backup_last_snapshot_completion_timestamp_seconds", nil, float64(time.Date(2018, 9, 11, 9, 20, 7, 0, time.UTC).Unix())},
+		{"backup_last_snapshot_items", nil, 118},
+		{"backup_last_snapshot_warnings", nil, 0},
+		{"backup_last_snapshot_errors", nil, 0},
+		{"backup_newest_snapshot_phase", map[string]string{"phase": "PartiallyFailed"}, 1},
+		{"backup_newest_snapshot_phase", map[string]string{"phase": "Completed"}, 0},
+		{"backup_newest_snapshot_phase", map[string]string{"phase": "FailedValidation"}, 0},
+	}
+	for _, test := range tests {
+		value, ok := metricValue(snapshot.Metrics, test.name, test.labels)
+		if !ok {
+			t.Errorf("%s%v - Expected a metric", test.name, test.labels)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("%s%v - Expected %f but got %f", test.name, test.labels, test.expected, value)
+		}
+	}
+	if _, ok := metricValue(snapshot.Metrics, "backup_last_snapshot_phase", map[string]string{"phase": "Completed"}); ok {
+		t.Errorf("Expected no phase of the latest backup, which is always completed")
+	}
+}
+
+func TestReport(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repo, teardown := setupTest(t, dir, "")
+	defer teardown()
+
+	report, err := repo.Report(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if listRequests != 1 {
+		t.Errorf("Expected the backups to be listed once but got %d listings", listRequests)
+	}
+	if report.Latest.Name != "daily-20180911091707" {
+		t.Errorf("Name - Expected %s but got %s", "daily-20180911091707", report.Latest.Name)
+	}
+	if len(report.Snapshots) != 1 || report.Size != nil {
+		t.Errorf("Expected the completed backup and no size but got %v and %v", report.Snapshots, report.Size)
+	}
+}
+
+func TestLatestSnapshotFailed(t *testing.T) {
+	t.Log("Testing a cluster without completed backups")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [{"metadata": {"name": "daily", "creationTimestamp": "2018-09-11T09:17:07Z"}, "status": {"phase": "Failed"}}]}`))
+	}))
+	defer ts.Close()
+
+	repo := OpenRepository("testRepo", "")
+	repo.Kubeconfig = writeKubeconfig(t, dir, ts, "    token: secret")
+	if _, err := repo.LatestSnapshot(context.Background()); err != collector.ErrSnapshotNotFound {
+		t.Errorf("Expected %v but got %v", collector.ErrSnapshotNotFound, err)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repo, teardown := setupTest(t, dir, "app=db,velero.io/schedule-name=daily")
+	defer teardown()
+	repo.LabelSelector = "app=db"
+	repo.Schedule = "daily"
+
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	// The running and failed backups are left out
+	if len(snapshots) != 1 || snapshots[0].Name != "daily-20180911091707" {
+		t.Fatalf("Expected the completed backup only but got %v", snapshots)
+	}
+}
+
+func TestNamespaceNotFound(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repo, teardown := setupTest(t, dir, "")
+	defer teardown()
+	repo.Namespace = "backups"
+
+	_, err := repo.LatestSnapshot(context.Background())
+	if err != collector.ErrSnapshotNotFound {
+		t.Errorf("Expected %v but got %v", collector.ErrSnapshotNotFound, err)
+	}
+}
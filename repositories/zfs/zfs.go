@@ -0,0 +1,208 @@
+package zfs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var execCommand = exec.CommandContext
+
+// Represents the informations about the ZFS dataset
+// used to retrieve informations about its snapshots
+type ZFSRepository struct {
+	// The repository alias
+	Alias,
+	// The dataset the snapshots are taken of, e.g. tank/data
+	Dataset,
+	// Optional regular expression the snapshot names must match, e.g. '^autosnap_.*_daily$'
+	Pattern string
+
+	collector.RepositoryOptions `mapstructure:",squash"`
+}
+
+type zfsSnapshot struct {
+	// The snapshot name, without the dataset
+	Name       string
+	Creation   time.Time
+	Used       float64
+	Referenced float64
+}
+
+func OpenRepository(alias, dataset string) *ZFSRepository {
+	return &ZFSRepository{
+		Alias:   alias,
+		Dataset: dataset,
+	}
+}
+
+// Lists the snapshots of the dataset matching the pattern, oldest first
+func (z *ZFSRepository) listSnapshots(ctx context.Context) ([]zfsSnapshot, error) {
+	var pattern *regexp.Regexp
+	if z.Pattern != "" {
+		var err error
+		pattern, err = regexp.Compile(z.Pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Depth 1 lists the snapshots of the dataset but not the ones of its children
+	cmd := execCommand(ctx, "zfs", "list", "-t", "snapshot", "-p", "-H",
+		"-o", "name,creation,used,referenced", "-s", "creation", "-d", "1", z.Dataset)
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			log.Printf("zfs process output: %s", exitErr.Stderr)
+			if strings.Contains(string(exitErr.Stderr), "dataset does not exist") {
+				return nil, collector.ErrSnapshotNotFound
+			}
+		}
+		return nil, err
+	}
+
+	var snapshots []zfsSnapshot
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+		snapshot, err := parseSnapshot(line)
+		if err != nil {
+			return nil, &collector.ParseError{Err: err}
+		}
+		if !strings.HasPrefix(snapshot.Name, z.Dataset+"@") {
+			continue
+		}
+		snapshot.Name = strings.TrimPrefix(snapshot.Name, z.Dataset+"@")
+		if pattern == nil || pattern.MatchString(snapshot.Name) {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+// Parses a line of zfs list, its tab separated fields hold exact values with -p
+func parseSnapshot(line string) (zfsSnapshot, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != 4 {
+		return zfsSnapshot{}, errors.New("unexpected zfs list line: " + line)
+	}
+
+	creation, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return zfsSnapshot{}, err
+	}
+	used, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return zfsSnapshot{}, err
+	}
+	referenced, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return zfsSnapshot{}, err
+	}
+
+	return zfsSnapshot{
+		Name:       fields[0],
+		Creation:   time.Unix(creation, 0),
+		Used:       used,
+		Referenced: referenced,
+	}, nil
+}
+
+func (snapshot *zfsSnapshot) backupSnapshot() *collector.BackupSnapshot {
+	return &collector.BackupSnapshot{
+		Name:       snapshot.Name,
+		DateString: snapshot.Creation.UTC().Format(time.UnixDate),
+		Size:       snapshot.Referenced,
+	}
+}
+
+// Returns an error when the dataset is missing or the pattern does not compile
+func (z *ZFSRepository) Validate() error {
+	if z.Dataset == "" {
+		return errors.New("the zfs dataset is required")
+	}
+	if z.Pattern != "" {
+		if _, err := regexp.Compile(z.Pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the alias of the ZFS repository
+func (z *ZFSRepository) AliasName() string {
+	return z.Alias
+}
+
+// Returns the repository type
+func (z *ZFSRepository) TypeName() string {
+	return "zfs"
+}
+
+// Retrieves informations about the latest snapshot of the dataset
+func (z *ZFSRepository) LatestSnapshot(ctx context.Context) (*collector.BackupSnapshot, error) {
+	report, err := z.Report(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return report.Latest, nil
+}
+
+// Retrieves the latest snapshot and all the snapshots of the dataset from a single listing
+func (z *ZFSRepository) Report(ctx context.Context) (*collector.RepositoryReport, error) {
+	snapshots, err := z.listSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snapshots) == 0 {
+		return nil, collector.ErrSnapshotNotFound
+	}
+
+	latest := snapshots[0]
+	for _, snapshot := range snapshots[1:] {
+		if !snapshot.Creation.Before(latest.Creation) {
+			latest = snapshot
+		}
+	}
+
+	backupSnapshot := latest.backupSnapshot()
+	backupSnapshot.Metrics = []collector.Metric{
+		{
+			Name:  "backup_last_snapshot_used_bytes",
+			Help:  "The space only held by the latest snapshot, ZFS and Btrfs only",
+			Value: latest.Used,
+		},
+		{
+			Name:  "backup_last_snapshot_referenced_bytes",
+			Help:  "The data referenced by the latest snapshot, ZFS and Btrfs only",
+			Value: latest.Referenced,
+		},
+	}
+	return &collector.RepositoryReport{Latest: backupSnapshot, Snapshots: backupSnapshots(snapshots)}, nil
+}
+
+// Retrieves informations about all the snapshots of the dataset
+func (z *ZFSRepository) Snapshots(ctx context.Context) ([]*collector.BackupSnapshot, error) {
+	zfsSnapshots, err := z.listSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return backupSnapshots(zfsSnapshots), nil
+}
+
+func backupSnapshots(zfsSnapshots []zfsSnapshot) []*collector.BackupSnapshot {
+	var snapshots []*collector.BackupSnapshot
+	for _, snapshot := range zfsSnapshots {
+		snapshots = append(snapshots, snapshot.backupSnapshot())
+	}
+	return snapshots
+}
@@ -0,0 +1,159 @@
+package zfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ddtmachado/prom-backup-exporter/collector"
+)
+
+var snapshotsOutput = "tank/data@autosnap_2018-09-11_09:17:07_daily\t1536657427\t1048576\t52428800\n" +
+	"tank/data@manual\t1536700000\t4096\t52000000\n" +
+	"tank/data@autosnap_2018-09-12_09:17:07_daily\t1536743827\t2097152\t53477376\n"
+
+// The number of zfs runs started by the test
+var execCount int
+
+func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
+	execCount++
+	cs := []string{"-test.run=TestHelperProcess", "--", command}
+	cs = append(cs, args...)
+	return exec.CommandContext(ctx, os.Args[0], cs...)
+}
+
+// Returns the zfs arguments when running as a fake zfs process, nil otherwise
+func helperArgs() []string {
+	for idx, arg := range os.Args {
+		if arg == "--" && idx+1 < len(os.Args) && os.Args[idx+1] == "zfs" {
+			return os.Args[idx+2:]
+		}
+	}
+	return nil
+}
+
+func TestHelperProcess(t *testing.T) {
+	args := helperArgs()
+	if args == nil {
+		return
+	}
+
+	cmdArgs := strings.Join(args, " ")
+	switch cmdArgs {
+	case "list -t snapshot -p -H -o name,creation,used,referenced -s creation -d 1 tank/data":
+		fmt.Fprintf(os.Stdout, "%s", snapshotsOutput)
+	case "list -t snapshot -p -H -o name,creation,used,referenced -s creation -d 1 tank/empty":
+	case "list -t snapshot -p -H -o name,creation,used,referenced -s creation -d 1 tank/missing":
+		fmt.Fprintf(os.Stderr, "cannot open 'tank/missing': dataset does not exist")
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "unexpected arguments %s", cmdArgs)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func setupTest(dataset string) (*ZFSRepository, func()) {
+	execCommand = fakeExecCommand
+	repo := OpenRepository("testRepo", dataset)
+	return repo, func() {
+		execCommand = exec.CommandContext
+	}
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	repo, teardown := setupTest("tank/data")
+	defer teardown()
+
+	snapshot, err := repo.LatestSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if snapshot.Name != "autosnap_2018-09-12_09:17:07_daily" {
+		t.Errorf("Name - Expected %s but got %s", "autosnap_2018-09-12_09:17:07_daily", snapshot.Name)
+	}
+
+	if snapshot.Size != 53477376 {
+		t.Errorf("Size - Expected %f but got %f", float64(53477376), snapshot.Size)
+	}
+
+	expected := time.Unix(1536743827, 0).UTC().Format(time.UnixDate)
+	if snapshot.DateString != expected {
+		t.Errorf("Date - Expected %s but got %s", expected, snapshot.DateString)
+	}
+
+	if len(snapshot.Metrics) != 2 || snapshot.Metrics[0].Value != 2097152 || snapshot.Metrics[1].Value != 53477376 {
+		t.Errorf("Metrics - Expected the used and referenced sizes but got %v", snapshot.Metrics)
+	}
+}
+
+func TestSnapshotsPattern(t *testing.T) {
+	repo, teardown := setupTest("tank/data")
+	defer teardown()
+	repo.Pattern = "_daily$"
+
+	snapshots, err := repo.Snapshots(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected 2 snapshots but got %d", len(snapshots))
+	}
+}
+
+func TestLatestSnapshotNotFound(t *testing.T) {
+	for _, dataset := range []string{"tank/empty", "tank/missing"} {
+		repo, teardown := setupTest(dataset)
+
+		_, err := repo.LatestSnapshot(context.Background())
+		if err != collector.ErrSnapshotNotFound {
+			t.Errorf("%s - Expected %v but got %v", dataset, collector.ErrSnapshotNotFound, err)
+		}
+		teardown()
+	}
+}
+
+func TestReport(t *testing.T) {
+	repo, teardown := setupTest("tank/data")
+	defer teardown()
+	repo.Pattern = "_daily$"
+
+	execCount = 0
+	report, err := repo.Report(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error - '%s'", err.Error())
+	}
+
+	if execCount != 1 {
+		t.Errorf("Expected a single zfs list run but got %d runs", execCount)
+	}
+	if report.Latest == nil || len(report.Latest.Metrics) != 2 {
+		t.Errorf("Expected the latest snapshot with its sizes but got %v", report.Latest)
+	}
+	if len(report.Snapshots) != 2 {
+		t.Errorf("Expected 2 snapshots but got %d", len(report.Snapshots))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := OpenRepository("testRepo", "").Validate(); err == nil {
+		t.Errorf("Expected an error for a missing dataset")
+	}
+
+	repo := OpenRepository("testRepo", "tank/data")
+	repo.Pattern = "("
+	if err := repo.Validate(); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+
+	repo.Pattern = "_daily$"
+	if err := repo.Validate(); err != nil {
+		t.Errorf("Unexpected error - '%s'", err.Error())
+	}
+}